@@ -6,6 +6,8 @@ import (
 
 const devGuildID = "1219548619129225226"
 
+var imagineMinCount = 1.0
+
 var devCommands = []*discordgo.ApplicationCommand{}
 
 var globalCommands = []*discordgo.ApplicationCommand{
@@ -25,6 +27,30 @@ var globalCommands = []*discordgo.ApplicationCommand{
 			},
 		},
 	},
+	{
+		Name:        "remind",
+		Description: "Manage your reminders",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List your pending reminders",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "cancel",
+				Description: "Cancel a pending reminder",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "id",
+						Description: "Reminder ID from /remind list",
+						Required:    true,
+					},
+				},
+			},
+		},
+	},
 	{
 		Name: "Timestamp",
 		Type: discordgo.MessageApplicationCommand,
@@ -89,6 +115,11 @@ var globalCommands = []*discordgo.ApplicationCommand{
 						Name:        "markdown",
 						Description: "Toggle markdown rendering for every response",
 					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "split",
+						Description: "Toggle splitting long responses across messages instead of rendering them",
+					},
 					{
 						Type:        discordgo.ApplicationCommandOptionSubCommand,
 						Name:        "code",
@@ -100,28 +131,11 @@ var globalCommands = []*discordgo.ApplicationCommand{
 						Description: "Change model",
 						Options: []*discordgo.ApplicationCommandOption{
 							{
-								Type:        discordgo.ApplicationCommandOptionString,
-								Name:        "name",
-								Description: "Model name",
-								Required:    true,
-								Choices: []*discordgo.ApplicationCommandOptionChoice{
-									{
-										Name:  "Gemini 3.5 Flash",
-										Value: "gemini-3.5-flash",
-									},
-									{
-										Name:  "Gemini 3.1 Pro",
-										Value: "gemini-3.1-pro-preview",
-									},
-									{
-										Name:  "Gemini 3 Flash",
-										Value: "gemini-3-flash-preview",
-									},
-									{
-										Name:  "Gemini 3.1 Flash Image",
-										Value: "gemini-3.1-flash-image",
-									},
-								},
+								Type:         discordgo.ApplicationCommandOptionString,
+								Name:         "name",
+								Description:  "Model name",
+								Required:     true,
+								Autocomplete: true,
 							},
 						},
 					},
@@ -211,6 +225,141 @@ var globalCommands = []*discordgo.ApplicationCommand{
 				Name:        "clear",
 				Description: "Clear the history",
 			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "threads",
+				Description: "Toggle starting a thread for each conversation in this channel",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "usage",
+				Description: "Show your and this server's Gemini usage and estimated cost",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "persona",
+				Description: "The bot's persona and instructions",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "set",
+						Description: "Edit the persona for this channel or server",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "scope",
+								Description: "Whether the persona applies to this channel or the whole server",
+								Required:    true,
+								Choices: []*discordgo.ApplicationCommandOptionChoice{
+									{Name: "This channel", Value: "channel"},
+									{Name: "This server", Value: "server"},
+								},
+							},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "show",
+						Description: "Show the persona used in this channel",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "reset",
+						Description: "Go back to the inherited persona for this channel or server",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "scope",
+								Description: "Whether the persona applies to this channel or the whole server",
+								Required:    true,
+								Choices: []*discordgo.ApplicationCommandOptionChoice{
+									{Name: "This channel", Value: "channel"},
+									{Name: "This server", Value: "server"},
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "tools",
+				Description: "Show the tools Gemini recently used in this channel",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "summary",
+				Description: "Summary of earlier history",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "show",
+						Description: "Show the summary of earlier history in this channel",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "reset",
+						Description: "Reset the summary of earlier history in this channel",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "toggle",
+						Description: "Toggle summarizing history once it is evicted",
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        "imagine",
+		Description: "Generate images with Gemini",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "What to draw",
+				Required:    true,
+				MaxLength:   4000,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "aspect",
+				Description: "Aspect ratio, 1:1 by default",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "1:1", Value: "1:1"},
+					{Name: "1:4", Value: "1:4"},
+					{Name: "1:8", Value: "1:8"},
+					{Name: "2:3", Value: "2:3"},
+					{Name: "3:2", Value: "3:2"},
+					{Name: "3:4", Value: "3:4"},
+					{Name: "4:1", Value: "4:1"},
+					{Name: "4:3", Value: "4:3"},
+					{Name: "4:5", Value: "4:5"},
+					{Name: "5:4", Value: "5:4"},
+					{Name: "8:1", Value: "8:1"},
+					{Name: "9:16", Value: "9:16"},
+					{Name: "16:9", Value: "16:9"},
+					{Name: "21:9", Value: "21:9"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "size",
+				Description: "Image size, 1K by default",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "512", Value: "512"},
+					{Name: "1K", Value: "1K"},
+					{Name: "2K", Value: "2K"},
+					{Name: "4K", Value: "4K"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "count",
+				Description: "Number of images, 1 by default",
+				MinValue:    &imagineMinCount,
+				MaxValue:    4,
+			},
 		},
 	},
 	{
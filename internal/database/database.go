@@ -10,10 +10,22 @@ import (
 
 var Pool *pgxpool.Pool
 
+// ReadOnlyPool runs queries written by Gemini. Point DATABASE_READONLY_URL at a
+// role that can only SELECT from the tables the tools expose; without it the
+// pool is nil and the tools that query the database are disabled.
+var ReadOnlyPool *pgxpool.Pool
+
 func init() {
 	var err error
 	Pool, err = pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
 	if err != nil {
 		log.Fatalln("Error connecting to database", err)
 	}
+
+	if url := os.Getenv("DATABASE_READONLY_URL"); url != "" {
+		ReadOnlyPool, err = pgxpool.New(context.Background(), url)
+		if err != nil {
+			log.Fatalln("Error connecting to read-only database", err)
+		}
+	}
 }
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const (
+	geminiAuditSchema = `
+		CREATE TABLE IF NOT EXISTS gemini_tool_calls (
+			id                  bigserial   PRIMARY KEY,
+			channel_id          bigint      NOT NULL,
+			requester_id        bigint      NOT NULL,
+			response_message_id bigint,
+			name                text        NOT NULL,
+			args                jsonb       NOT NULL,
+			started_at          timestamptz NOT NULL,
+			duration_ms         integer     NOT NULL,
+			row_count           integer     NOT NULL,
+			error               text,
+			sources             jsonb       NOT NULL DEFAULT '[]'
+		);
+		CREATE INDEX IF NOT EXISTS gemini_tool_calls_response_idx ON gemini_tool_calls (response_message_id);
+		CREATE INDEX IF NOT EXISTS gemini_tool_calls_channel_idx ON gemini_tool_calls (channel_id, id);
+	`
+
+	maxSourcesPerCall = 10
+	maxSourceLabel    = 80
+	maxToolCallsShown = 10
+)
+
+// toolCall is one function call the model made, as recorded in the audit log.
+type toolCall struct {
+	name      string
+	args      map[string]any
+	startedAt time.Time
+	duration  time.Duration
+	rows      int
+	err       error
+	sources   []toolSource
+}
+
+// toolSource is a message or conversation a tool call's result came from.
+type toolSource struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+func init() {
+	if _, err := database.Pool.Exec(context.Background(), geminiAuditSchema); err != nil {
+		log.Println("Error creating Gemini tool call table", err)
+	}
+	registerComponentHandler("geminiSources", geminiSourcesHandler)
+}
+
+// logToolCall stores a tool call made during the turn. The response message
+// isn't known yet, so linkToolCalls fills it in once the response is sent.
+func (t *turn) logToolCall(call toolCall) {
+	id, err := insertToolCall(context.Background(), t.channelID, t.requesterID, call)
+	if err != nil {
+		log.Println("Error logging Gemini tool call", err)
+		return
+	}
+	t.toolCallIDs = append(t.toolCallIDs, id)
+}
+
+func insertToolCall(ctx context.Context, channelID, requesterID string, call toolCall) (int64, error) {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	rID, err := strconv.ParseInt(requesterID, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	args, err := json.Marshal(call.args)
+	if err != nil {
+		return 0, err
+	}
+	sources, err := json.Marshal(call.sources)
+	if err != nil {
+		return 0, err
+	}
+	var callErr *string
+	if call.err != nil {
+		msg := call.err.Error()
+		callErr = &msg
+	}
+	var id int64
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO gemini_tool_calls (channel_id, requester_id, name, args, started_at, duration_ms, row_count, error, sources)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`, cID, rID, call.name, args, call.startedAt, call.duration.Milliseconds(), call.rows, callErr, sources).Scan(&id)
+	return id, err
+}
+
+// linkToolCalls attaches tool calls to the message that shows their sources
+// button. Calls from an earlier, regenerated response are detached first.
+func linkToolCalls(ctx context.Context, msgID string, ids []int64) error {
+	mID, err := strconv.ParseInt(msgID, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `UPDATE gemini_tool_calls SET response_message_id = NULL WHERE response_message_id = $1`, mID)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `UPDATE gemini_tool_calls SET response_message_id = $1 WHERE id = ANY($2)`, mID, ids)
+	return err
+}
+
+// loadToolCalls returns tool calls in the order they were made, either those
+// linked to a response message or the most recent ones in a channel.
+func loadToolCalls(ctx context.Context, where string, arg int64, limit int) ([]toolCall, error) {
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+		SELECT name, args, started_at, duration_ms, row_count, error, sources
+		FROM (
+			SELECT *
+			FROM gemini_tool_calls
+			WHERE %s = $1
+			ORDER BY id DESC
+			LIMIT $2
+		) recent
+		ORDER BY id
+	`, where), arg, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var calls []toolCall
+	for rows.Next() {
+		var call toolCall
+		var args, sources []byte
+		var durationMs int64
+		var callErr *string
+		if err := rows.Scan(&call.name, &args, &call.startedAt, &durationMs, &call.rows, &callErr, &sources); err != nil {
+			return nil, err
+		}
+		call.duration = time.Duration(durationMs) * time.Millisecond
+		if callErr != nil {
+			call.err = fmt.Errorf("%s", *callErr)
+		}
+		if err := json.Unmarshal(args, &call.args); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(sources, &call.sources); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, rows.Err()
+}
+
+func messageLink(msgID string) string {
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, msgID)
+}
+
+func sourceLabel(t time.Time, content string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	if len(content) > maxSourceLabel {
+		content = strings.ToValidUTF8(content[:maxSourceLabel], "") + "…"
+	}
+	// Square brackets would end the masked link early.
+	content = strings.NewReplacer("[", "(", "]", ")").Replace(content)
+	return strings.TrimSpace(t.In(timeZone).Format("2006-01-02 15:04") + " " + content)
+}
+
+// messageSources links to the archived messages in SQL results that include a
+// message_id column.
+func messageSources(rows []map[string]any) []toolSource {
+	var sources []toolSource
+	for _, row := range rows {
+		if len(sources) == maxSourcesPerCall {
+			break
+		}
+		id, ok := row["message_id"].(int64)
+		if !ok {
+			continue
+		}
+		msgID := strconv.FormatInt(id, 10)
+		mTime, err := discordgo.SnowflakeTimestamp(msgID)
+		if err != nil {
+			continue
+		}
+		content, _ := row["content"].(string)
+		sources = append(sources, toolSource{Label: sourceLabel(mTime, content), URL: messageLink(msgID)})
+	}
+	return sources
+}
+
+// chunkSources links to where each semantic search chunk starts. Chunks don't
+// keep message IDs, so the link uses a snowflake for the chunk's start time,
+// which Discord resolves to the nearest message.
+func chunkSources(rows []map[string]any) []toolSource {
+	var sources []toolSource
+	for _, row := range rows {
+		if len(sources) == maxSourcesPerCall {
+			break
+		}
+		startMs, ok := row["start_ms"].(int64)
+		if !ok {
+			continue
+		}
+		start := time.UnixMilli(startMs)
+		content, _ := row["content"].(string)
+		// Drop the "[YYYY-MM-DD HH:MM] " prefix of the first line.
+		if _, rest, found := strings.Cut(content, "] "); found {
+			content = rest
+		}
+		sources = append(sources, toolSource{Label: sourceLabel(start, content), URL: messageLink(snowflakeForTime(start))})
+	}
+	return sources
+}
+
+// formatToolCalls describes tool calls for the sources and tools views.
+func formatToolCalls(calls []toolCall, withTime bool) string {
+	var sb strings.Builder
+	for _, call := range calls {
+		fmt.Fprintf(&sb, "**%s**", call.name)
+		if withTime {
+			fmt.Fprintf(&sb, " · <t:%d:R>", call.startedAt.Unix())
+		}
+		fmt.Fprintf(&sb, " · %d rows · %.1fs\n", call.rows, call.duration.Seconds())
+		if query, ok := call.args["query"].(string); ok {
+			if call.name == "search_messages_semantic" {
+				fmt.Fprintf(&sb, "> %s\n", strings.Join(strings.Fields(query), " "))
+			} else {
+				fmt.Fprintf(&sb, "```sql\n%s\n```\n", strings.ReplaceAll(query, "```", "`\u200b``"))
+			}
+		}
+		if call.err != nil {
+			fmt.Fprintf(&sb, "❌ %s\n", call.err)
+		}
+		for _, src := range call.sources {
+			fmt.Fprintf(&sb, "- [%s](%s)\n", src.Label, src.URL)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func sourcesComponent() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    "Sources",
+		Style:    discordgo.SecondaryButton,
+		CustomID: "geminiSources",
+		Emoji:    &discordgo.ComponentEmoji{Name: "📚"},
+	}
+}
+
+func geminiSourcesHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	msgID, err := strconv.ParseInt(i.Message.ID, 10, 64)
+	if err != nil {
+		log.Println("Error parsing message ID", err)
+		return
+	}
+	calls, err := loadToolCalls(context.Background(), "response_message_id", msgID, maxToolCallsShown)
+	if err != nil {
+		log.Println("Error loading Gemini tool calls", err)
+		respondEphemeral(s, i, "Failed to load the sources for this response")
+		return
+	}
+	if len(calls) == 0 {
+		respondEphemeral(s, i, "This response didn't use any tools")
+		return
+	}
+	respondToolCalls(s, i, "Sources", formatToolCalls(calls, false))
+}
+
+func respondToolCalls(s *discordgo.Session, i *discordgo.InteractionCreate, title, description string) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       title,
+					Color:       0xffffff,
+					Description: getValidString(description, maxEmbedLength),
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
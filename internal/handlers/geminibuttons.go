@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+)
+
+const maxTrackedResponses = 1000
+
+// responseState is what the buttons on a finished response need to act on it.
+type responseState struct {
+	channelID   string
+	requesterID string
+	us          userSettings // requester's settings when the response was made
+	msgIDs      []string     // messages the response was sent as, buttons on the last
+	entries     []int64      // seqs of the history entries the response added
+}
+
+var (
+	responsesMu   sync.Mutex                    // guards responses and responseOrder
+	responses     = map[string]*responseState{} // last message ID -> response
+	responseOrder []string
+)
+
+func stopComponents() []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Stop",
+					Style:    discordgo.DangerButton,
+					CustomID: "geminiStop",
+					Emoji:    &discordgo.ComponentEmoji{Name: "🛑"},
+				},
+			},
+		},
+	}
+}
+
+// responseComponents returns the buttons for a finished response, including a
+// sources button if it used any tools.
+func responseComponents(sources bool) []discordgo.MessageComponent {
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "Regenerate",
+			Style:    discordgo.SecondaryButton,
+			CustomID: "geminiRegenerate",
+			Emoji:    &discordgo.ComponentEmoji{Name: "🔄"},
+		},
+		discordgo.Button{
+			Label:    "Continue",
+			Style:    discordgo.SecondaryButton,
+			CustomID: "geminiContinue",
+			Emoji:    &discordgo.ComponentEmoji{Name: "⏩"},
+		},
+	}
+	if sources {
+		buttons = append(buttons, sourcesComponent())
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}}
+}
+
+// trackResponse remembers a finished response so its buttons work. Only the
+// most recent maxTrackedResponses are kept.
+func trackResponse(rs *responseState) {
+	if len(rs.msgIDs) == 0 {
+		return
+	}
+	responsesMu.Lock()
+	defer responsesMu.Unlock()
+	key := rs.msgIDs[len(rs.msgIDs)-1]
+	responses[key] = rs
+	responseOrder = append(responseOrder, key)
+	if len(responseOrder) > maxTrackedResponses {
+		delete(responses, responseOrder[0])
+		responseOrder = responseOrder[1:]
+	}
+}
+
+func lookupResponse(msgID string) *responseState {
+	responsesMu.Lock()
+	defer responsesMu.Unlock()
+	return responses[msgID]
+}
+
+// takeResponse looks up a response and stops tracking it.
+func takeResponse(msgID string) *responseState {
+	responsesMu.Lock()
+	defer responsesMu.Unlock()
+	rs := responses[msgID]
+	delete(responses, msgID)
+	return rs
+}
+
+// removeTurn removes a response's entries from its channel's history. It
+// returns why it can't if the model has responded again since, because only
+// the latest response can be replaced, or if the entries are already gone.
+func removeTurn(channelID string, entries []int64) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	inTurn := make(map[int64]bool, len(entries))
+	for _, seq := range entries {
+		inTurn[seq] = true
+	}
+
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	h := history[channelID]
+	first := -1
+	for i, e := range h {
+		if inTurn[e.seq] {
+			if first < 0 {
+				first = i
+			}
+		} else if first >= 0 && e.content.Role == genai.RoleModel {
+			return "Only the latest response in this channel can be regenerated"
+		}
+	}
+	if first < 0 {
+		return "This response is no longer in the channel's history, so it can't be regenerated"
+	}
+	kept := h[:first:first]
+	var removed []historyEntry
+	for _, e := range h[first:] {
+		if inTurn[e.seq] {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	history[channelID] = kept
+	queueDeleteHistoryEntries(removed)
+	return ""
+}
+
+// canControlResponse reports whether the user who pressed a button may act on
+// a response, which only its requester and moderators can.
+func canControlResponse(i *discordgo.InteractionCreate, requesterID string) bool {
+	if i.Member != nil {
+		return i.Member.User.ID == requesterID || i.Member.Permissions&discordgo.PermissionManageMessages != 0
+	}
+	return i.User != nil && i.User.ID == requesterID
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
+
+func geminiStopHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	generationsMu.Lock()
+	gen := generations[i.Message.ID]
+	generationsMu.Unlock()
+	if gen == nil {
+		respondEphemeral(s, i, "This response has already finished")
+		return
+	}
+	if !canControlResponse(i, gen.requesterID) {
+		respondEphemeral(s, i, "Only the person who asked or a moderator can stop this response")
+		return
+	}
+	gen.cancel()
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+}
+
+// geminiStopReactionHandler stops a response when its requester or a
+// moderator reacts to it with 🛑, like the Stop button.
+func geminiStopReactionHandler(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.Emoji.Name != "🛑" || r.UserID == s.State.User.ID {
+		return
+	}
+	generationsMu.Lock()
+	gen := generations[r.MessageID]
+	generationsMu.Unlock()
+	if gen == nil {
+		return
+	}
+	if r.UserID != gen.requesterID {
+		perms, err := s.State.UserChannelPermissions(r.UserID, r.ChannelID)
+		if err != nil {
+			perms, err = s.UserChannelPermissions(r.UserID, r.ChannelID)
+		}
+		if err != nil || perms&discordgo.PermissionManageMessages == 0 {
+			return
+		}
+	}
+	gen.cancel()
+	// Removing the reaction needs Manage Messages, which the bot may not have.
+	s.MessageReactionRemove(r.ChannelID, r.MessageID, r.Emoji.APIName(), r.UserID)
+}
+
+// cutShortContent turns whatever was generated before a response was stopped
+// or failed into a history entry. Function calls are dropped since they will
+// never get a response, and a note tells the model why the answer was cut
+// short.
+func cutShortContent(c *genai.Content, note string) *genai.Content {
+	cut := &genai.Content{Role: genai.RoleModel}
+	if c != nil {
+		for _, p := range c.Parts {
+			if p.FunctionCall == nil {
+				cut.Parts = append(cut.Parts, p)
+			}
+		}
+	}
+	cut.Parts = append(cut.Parts, genai.NewPartFromText("\n"+note))
+	return cut
+}
+
+func geminiRegenerateHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	rs := takeResponse(i.Message.ID)
+	if rs == nil {
+		respondEphemeral(s, i, "This response can no longer be regenerated")
+		return
+	}
+	if !canControlResponse(i, rs.requesterID) {
+		trackResponse(rs)
+		respondEphemeral(s, i, "Only the person who asked or a moderator can regenerate this response")
+		return
+	}
+	reservation, refusal := reserveQuota(s, rs.channelID, rs.requesterID, rs.us.model, 1)
+	if refusal != "" {
+		trackResponse(rs)
+		respondEphemeral(s, i, refusal)
+		return
+	}
+	if refusal := removeTurn(rs.channelID, rs.entries); refusal != "" {
+		releaseQuota(reservation)
+		trackResponse(rs)
+		respondEphemeral(s, i, refusal)
+		return
+	}
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	for _, msgID := range rs.msgIDs[1:] {
+		if err := s.ChannelMessageDelete(rs.channelID, msgID); err != nil {
+			log.Println("Error deleting message", err)
+		}
+	}
+	respond(s, rs.channelID, rs.requesterID, rs.us, rs.msgIDs[0], firstReservation(reservation))
+}
+
+func geminiContinueHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	rs := lookupResponse(i.Message.ID)
+	if rs == nil {
+		respondEphemeral(s, i, "This response can no longer be continued")
+		return
+	}
+	if !canControlResponse(i, rs.requesterID) {
+		respondEphemeral(s, i, "Only the person who asked or a moderator can continue this response")
+		return
+	}
+	reservation, refusal := reserveQuota(s, rs.channelID, rs.requesterID, rs.us.model, 1)
+	if refusal != "" {
+		respondEphemeral(s, i, refusal)
+		return
+	}
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+
+	// Ask to continue as if the button presser had mentioned the bot.
+	m := &discordgo.Message{
+		ID:        i.ID,
+		ChannelID: rs.channelID,
+		GuildID:   i.GuildID,
+		Content:   "<@" + s.State.User.ID + "> Continue your previous response from exactly where it left off.",
+		Mentions:  []*discordgo.User{s.State.User},
+		Member:    i.Member,
+		Author:    i.User,
+	}
+	if i.Member != nil {
+		m.Author = i.Member.User
+	}
+	parts, _, err := buildPartsFromMessage(s, m)
+	if err != nil {
+		log.Println("Error building user parts", err)
+		releaseQuota(reservation)
+		return
+	}
+	appendHistory(rs.channelID, "", genai.NewContentFromParts(parts, genai.RoleUser))
+	respond(s, rs.channelID, rs.requesterID, rs.us, "", firstReservation(reservation))
+}
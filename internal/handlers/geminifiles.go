@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genai"
+)
+
+const (
+	maxTextFileBytes = 100_000
+	// How much of a file without a telling type or extension is checked to
+	// decide whether it is text.
+	textSniffBytes = 8192
+)
+
+var (
+	// Types Gemini accepts as inline data or uploaded files.
+	geminiMediaTypes = map[string]bool{
+		"image/png": true, "image/jpeg": true, "image/webp": true, "image/heic": true, "image/heif": true,
+		"application/pdf": true,
+		"audio/wav":       true, "audio/mp3": true, "audio/aiff": true, "audio/aac": true, "audio/ogg": true, "audio/flac": true,
+		"video/mp4": true, "video/mpeg": true, "video/mov": true, "video/avi": true, "video/x-flv": true,
+		"video/mpg": true, "video/webm": true, "video/wmv": true, "video/3gpp": true,
+	}
+
+	// Other names for the types above, as reported by Discord or browsers.
+	mediaTypeAliases = map[string]string{
+		"image/jpg":       "image/jpeg",
+		"image/pjpeg":     "image/jpeg",
+		"audio/mpeg":      "audio/mp3",
+		"audio/x-mpeg":    "audio/mp3",
+		"audio/mpeg3":     "audio/mp3",
+		"audio/x-wav":     "audio/wav",
+		"audio/wave":      "audio/wav",
+		"audio/vnd.wave":  "audio/wav",
+		"audio/x-aiff":    "audio/aiff",
+		"audio/x-aac":     "audio/aac",
+		"audio/mp4":       "audio/aac",
+		"audio/x-m4a":     "audio/aac",
+		"audio/x-flac":    "audio/flac",
+		"audio/opus":      "audio/ogg",
+		"video/quicktime": "video/mov",
+		"video/x-msvideo": "video/avi",
+		"video/x-ms-wmv":  "video/wmv",
+		"video/mpg4":      "video/mp4",
+	}
+
+	// Non-text/* types whose contents are text.
+	textMediaTypes = map[string]bool{
+		"application/json": true, "application/ld+json": true, "application/xml": true,
+		"application/javascript": true, "application/x-javascript": true, "application/typescript": true,
+		"application/x-sh": true, "application/x-shellscript": true, "application/x-python": true,
+		"application/x-yaml": true, "application/yaml": true, "application/toml": true, "application/sql": true,
+		"application/x-httpd-php": true, "application/x-tex": true, "application/graphql": true,
+		"image/svg+xml": true,
+	}
+
+	// Extensions of source and other text files that Discord reports as
+	// application/octet-stream or without a type at all.
+	textFileExtensions = map[string]bool{
+		".txt": true, ".md": true, ".log": true, ".csv": true, ".tsv": true, ".json": true, ".jsonl": true,
+		".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".cfg": true, ".conf": true, ".env": true,
+		".xml": true, ".html": true, ".htm": true, ".css": true, ".scss": true, ".svg": true, ".sql": true,
+		".go": true, ".mod": true, ".py": true, ".js": true, ".mjs": true, ".cjs": true, ".ts": true, ".tsx": true, ".jsx": true,
+		".java": true, ".kt": true, ".kts": true, ".scala": true, ".c": true, ".h": true, ".cc": true, ".cpp": true, ".hpp": true,
+		".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".m": true, ".lua": true, ".pl": true,
+		".r": true, ".dart": true, ".zig": true, ".hs": true, ".ex": true, ".exs": true, ".erl": true, ".clj": true,
+		".sh": true, ".bash": true, ".zsh": true, ".fish": true, ".ps1": true, ".bat": true, ".cmd": true,
+		".vue": true, ".svelte": true, ".gradle": true, ".tex": true, ".diff": true, ".patch": true, ".proto": true,
+		".graphql": true, ".tf": true, ".nix": true, ".dockerfile": true, ".makefile": true, ".gitignore": true,
+	}
+)
+
+// normalizeMediaType maps a file's reported type to one Gemini accepts. It
+// returns "text/plain" for anything that should be sent as text, and the
+// type as reported if Gemini can't take the file at all.
+func normalizeMediaType(mediaType, filename string, data []byte) string {
+	mediaType = strings.ToLower(mediaType)
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	switch {
+	case geminiMediaTypes[mediaType]:
+		return mediaType
+	case strings.HasPrefix(mediaType, "text/"), textMediaTypes[mediaType], textFileExtensions[ext]:
+		return "text/plain"
+	case mediaType == "" || mediaType == "application/octet-stream":
+		// Guess from the extension, then from the contents.
+		if guess, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil && guess != "application/octet-stream" {
+			return normalizeMediaType(guess, "", data)
+		}
+		if looksLikeText(data) {
+			return "text/plain"
+		}
+		if guess, _, err := mime.ParseMediaType(http.DetectContentType(data)); err == nil && guess != "application/octet-stream" {
+			return normalizeMediaType(guess, "", data)
+		}
+	}
+	if mediaType == "" {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+func looksLikeText(data []byte) bool {
+	sample := data[:min(len(data), textSniffBytes)]
+	if len(sample) == 0 || bytes.IndexByte(sample, 0) >= 0 {
+		return false
+	}
+	// The sample may end in the middle of a rune.
+	for i := 0; i < utf8.UTFMax && len(sample) > 0 && !utf8.Valid(sample); i++ {
+		sample = sample[:len(sample)-1]
+	}
+	return utf8.Valid(sample)
+}
+
+// textFilePart wraps a text file's contents in a header naming the file.
+func textFilePart(filename string, data []byte) *genai.Part {
+	text := strings.ToValidUTF8(string(data), "�")
+	var note string
+	if len(text) > maxTextFileBytes {
+		text = strings.ToValidUTF8(text[:maxTextFileBytes], "")
+		note = fmt.Sprintf("\n[truncated, only the first %d bytes are shown]", maxTextFileBytes)
+	}
+	return genai.NewPartFromText(fmt.Sprintf("[file: %s]\n%s%s\n[end of file: %s]", filename, text, note, filename))
+}
+
+// attachmentPart turns a fetched file into a part Gemini accepts, or returns
+// an error saying why it can't.
+func attachmentPart(ctx context.Context, data []byte, fm fetchedMedia, filename string) (*genai.Part, error) {
+	mediaType := normalizeMediaType(fm.mimeType, filename, data)
+	if mediaType == "text/plain" {
+		return textFilePart(filename, data), nil
+	}
+	if !geminiMediaTypes[mediaType] {
+		return nil, fmt.Errorf("`%s` files aren't supported", mediaType)
+	}
+	fm.mimeType = mediaType
+	return mediaPart(ctx, data, fm), nil
+}
+
+// skippedFilePart tells the model about a file it can't see, so it doesn't
+// act as if the message had no attachment.
+func skippedFilePart(filename string, err error) *genai.Part {
+	return genai.NewPartFromText(fmt.Sprintf("[attachment %s could not be read: %s]", filename, strings.ReplaceAll(err.Error(), "`", "")))
+}
@@ -0,0 +1,491 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const (
+	geminiHistorySchema = `
+		CREATE TABLE IF NOT EXISTS gemini_history (
+			id         bigserial PRIMARY KEY,
+			channel_id bigint    NOT NULL,
+			message_id bigint,
+			seq        bigint    NOT NULL UNIQUE, -- order of the entry, see nextHistorySeq
+			content    jsonb     NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS gemini_history_channel_id_idx ON gemini_history (channel_id, seq);
+		-- Bot threads whose history stays in the database until they are unarchived.
+		CREATE TABLE IF NOT EXISTS gemini_archived_threads (
+			thread_id bigint PRIMARY KEY
+		);
+	`
+
+	historyBackfillMessages = 50
+)
+
+var (
+	// Matches the delimiter part appended by buildPartsFromMessage. The
+	// delimiter is regenerated on every start, so stored parts are rewritten
+	// to the current one when they are loaded.
+	delimiterPartRegexp = regexp.MustCompile(`^\ndelimiter: [0-9a-f-]{36}\n\n$`)
+
+	historyBackfillOnce sync.Once
+
+	historySeq int64 // last seq handed out by nextHistorySeq; guarded by geminiMu
+
+	historyWritesMu    sync.Mutex
+	historyWrites      []func(context.Context) error
+	historyWritesReady = make(chan struct{}, 1)
+)
+
+func init() {
+	ctx := context.Background()
+	if _, err := database.Pool.Exec(ctx, geminiHistorySchema); err != nil {
+		log.Println("Error creating Gemini history table", err)
+	}
+	if err := loadHistory(ctx); err != nil {
+		log.Println("Error loading Gemini history", err)
+	}
+	registerReadyHandler(geminiHistoryReadyHandler)
+	go runHistoryWrites()
+}
+
+func geminiHistoryReadyHandler(s *discordgo.Session, r *discordgo.Ready) {
+	historyBackfillOnce.Do(func() {
+		if err := backfillHistory(context.Background(), s); err != nil {
+			log.Println("Error backfilling Gemini history", err)
+		}
+	})
+}
+
+func delimiterPart() *genai.Part {
+	return genai.NewPartFromText(fmt.Sprintf("\ndelimiter: %s\n\n", delimiter))
+}
+
+// nextHistorySeq returns a number that orders a new history entry after every
+// earlier one, across restarts too. geminiMu must be held.
+func nextHistorySeq() int64 {
+	historySeq = max(historySeq+1, time.Now().UnixMicro())
+	return historySeq
+}
+
+// queueHistoryWrite runs a write to gemini_history in the background. Writes
+// run one at a time in the order they were queued, so callers queue them
+// while holding geminiMu to keep the table in step with the history map.
+func queueHistoryWrite(write func(ctx context.Context) error) {
+	historyWritesMu.Lock()
+	historyWrites = append(historyWrites, write)
+	historyWritesMu.Unlock()
+	select {
+	case historyWritesReady <- struct{}{}:
+	default:
+	}
+}
+
+func runHistoryWrites() {
+	for range historyWritesReady {
+		for {
+			historyWritesMu.Lock()
+			if len(historyWrites) == 0 {
+				historyWritesMu.Unlock()
+				break
+			}
+			write := historyWrites[0]
+			historyWrites = historyWrites[1:]
+			historyWritesMu.Unlock()
+			if err := write(context.Background()); err != nil {
+				log.Println("Error writing Gemini history", err)
+			}
+		}
+	}
+}
+
+// snapshotContent copies the part list of a history entry's content, which
+// may be replaced after a write is queued.
+func snapshotContent(c *genai.Content) *genai.Content {
+	return &genai.Content{Role: c.Role, Parts: slices.Clone(c.Parts)}
+}
+
+// encodeContent serializes a history entry's content for storage. genai's JSON
+// encoding round-trips every part type we keep in history, including function
+// calls and responses, and thought signatures. Inline media is moved to the
+// media cache and stored as a reference to it, which refreshMedia turns back
+// into inline data or an upload when the entry is sent again.
+func encodeContent(c *genai.Content) ([]byte, error) {
+	stored := &genai.Content{Role: c.Role, Parts: make([]*genai.Part, len(c.Parts))}
+	for i, p := range c.Parts {
+		if p == nil || p.InlineData == nil {
+			stored.Parts[i] = p
+			continue
+		}
+		sum := sha256.Sum256(p.InlineData.Data)
+		hash := hex.EncodeToString(sum[:])
+		if err := writeCachedMedia(hash, p.InlineData.Data); err != nil {
+			// Keep the rest of the entry; the media is lost as if it had
+			// left the cache.
+			log.Println("Error caching history media", err)
+			stored.Parts[i] = genai.NewPartFromText(fmt.Sprintf("[%s attachment expired]", p.InlineData.MIMEType))
+			continue
+		}
+		ref := *p
+		ref.InlineData = nil
+		ref.FileData = &genai.FileData{MIMEType: p.InlineData.MIMEType, DisplayName: hash}
+		stored.Parts[i] = &ref
+	}
+	return json.Marshal(stored)
+}
+
+func decodeContent(data []byte) (*genai.Content, error) {
+	var c genai.Content
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	for i, p := range c.Parts {
+		if p != nil && delimiterPartRegexp.MatchString(p.Text) {
+			c.Parts[i] = delimiterPart()
+		}
+	}
+	return &c, nil
+}
+
+// loadHistory rehydrates the history map from the database, except for
+// archived threads, which are loaded by restoreThread when they are used again.
+func loadHistory(ctx context.Context) error {
+	if err := loadArchivedThreads(ctx); err != nil {
+		return err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT seq, channel_id, message_id, content
+		FROM gemini_history
+		WHERE channel_id NOT IN (SELECT thread_id FROM gemini_archived_threads)
+		ORDER BY channel_id, seq
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loaded := map[string][]historyEntry{}
+	count := 0
+	for rows.Next() {
+		var seq, channelID int64
+		var msgID *int64
+		var data []byte
+		if err := rows.Scan(&seq, &channelID, &msgID, &data); err != nil {
+			return err
+		}
+		c, err := decodeContent(data)
+		if err != nil {
+			log.Println("Error decoding Gemini history entry", seq, err)
+			continue
+		}
+		e := historyEntry{seq: seq, content: c, tokens: estimateTokens(c)}
+		if msgID != nil {
+			e.msgID = strconv.FormatInt(*msgID, 10)
+		}
+		key := strconv.FormatInt(channelID, 10)
+		loaded[key] = append(loaded[key], e)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	for channelID, entries := range loaded {
+		history[channelID] = append(entries, history[channelID]...)
+	}
+	if count > 0 {
+		log.Printf("Loaded %d Gemini history entries across %d channel(s)", count, len(loaded))
+	}
+	return nil
+}
+
+func loadArchivedThreads(ctx context.Context) error {
+	rows, err := database.Pool.Query(ctx, `SELECT thread_id FROM gemini_archived_threads`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	for rows.Next() {
+		var threadID int64
+		if err := rows.Scan(&threadID); err != nil {
+			return err
+		}
+		archivedThreads[strconv.FormatInt(threadID, 10)] = true
+	}
+	return rows.Err()
+}
+
+// queueSetThreadArchived stores whether a thread is archived. geminiMu must be
+// held.
+func queueSetThreadArchived(threadID string, archived bool) {
+	queueHistoryWrite(func(ctx context.Context) error {
+		tID, err := strconv.ParseInt(threadID, 10, 64)
+		if err != nil {
+			return err
+		}
+		if archived {
+			_, err = database.Pool.Exec(ctx, `INSERT INTO gemini_archived_threads (thread_id) VALUES ($1) ON CONFLICT DO NOTHING`, tID)
+		} else {
+			_, err = database.Pool.Exec(ctx, `DELETE FROM gemini_archived_threads WHERE thread_id = $1`, tID)
+		}
+		return err
+	})
+}
+
+// loadChannelHistory reloads one channel's history from the database, for a
+// thread whose history was freed when it was archived. Entries appended while
+// the reload was running are kept.
+func loadChannelHistory(ctx context.Context, channelID string) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT seq, message_id, content
+		FROM gemini_history
+		WHERE channel_id = $1
+		ORDER BY seq
+	`, cID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var loaded []historyEntry
+	for rows.Next() {
+		var seq int64
+		var msgID *int64
+		var data []byte
+		if err := rows.Scan(&seq, &msgID, &data); err != nil {
+			return err
+		}
+		c, err := decodeContent(data)
+		if err != nil {
+			log.Println("Error decoding Gemini history entry", seq, err)
+			continue
+		}
+		e := historyEntry{seq: seq, content: c, tokens: estimateTokens(c)}
+		if msgID != nil {
+			e.msgID = strconv.FormatInt(*msgID, 10)
+		}
+		loaded = append(loaded, e)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	for _, e := range history[channelID] {
+		if !containsEntry(loaded, e.seq) {
+			loaded = append(loaded, e)
+		}
+	}
+	history[channelID] = loaded
+	return nil
+}
+
+// backfillHistory seeds the archived channel's history from the messages table
+// when nothing has been stored for it yet.
+func backfillHistory(ctx context.Context, s *discordgo.Session) error {
+	geminiMu.Lock()
+	empty := len(history[channelID]) == 0
+	geminiMu.Unlock()
+	if !empty {
+		return nil
+	}
+	botID, err := strconv.ParseInt(s.State.User.ID, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT message_id, user_id, content
+		FROM (
+			SELECT message_id, user_id, content
+			FROM messages
+			WHERE user_id <> $1 AND content <> ''
+			ORDER BY message_id DESC
+			LIMIT $2
+		) recent
+		ORDER BY message_id
+	`, botID, historyBackfillMessages)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var msgs []*discordgo.Message
+	members := map[int64]*discordgo.Member{}
+	for rows.Next() {
+		var msgID, userID int64
+		var content string
+		if err := rows.Scan(&msgID, &userID, &content); err != nil {
+			return err
+		}
+		member, ok := members[userID]
+		if !ok {
+			member = lookupMember(s, guildID, strconv.FormatInt(userID, 10))
+			members[userID] = member
+		}
+		m := &discordgo.Message{
+			ID:        strconv.FormatInt(msgID, 10),
+			ChannelID: channelID,
+			GuildID:   guildID,
+			Content:   content,
+			Author:    &discordgo.User{ID: strconv.FormatInt(userID, 10), Username: strconv.FormatInt(userID, 10)},
+		}
+		if member != nil {
+			m.Member = member
+			m.Author = member.User
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The seqs are taken first so that entries appended while the parts are
+	// built still come after the backfilled ones.
+	seqs := make([]int64, len(msgs))
+	geminiMu.Lock()
+	for n := range seqs {
+		seqs[n] = nextHistorySeq()
+	}
+	geminiMu.Unlock()
+
+	entries := make([]historyEntry, 0, len(msgs))
+	for n, m := range msgs {
+		parts, _, err := buildPartsFromMessage(s, m)
+		if err != nil {
+			log.Println("Error building backfilled parts", err)
+			continue
+		}
+		c := genai.NewContentFromParts(parts, genai.RoleUser)
+		entries = append(entries, historyEntry{seq: seqs[n], msgID: m.ID, content: c, tokens: estimateTokens(c)})
+	}
+
+	geminiMu.Lock()
+	history[channelID] = append(entries, history[channelID]...)
+	for _, e := range entries {
+		queueInsertHistoryEntry(channelID, e)
+	}
+	geminiMu.Unlock()
+	if len(entries) > 0 {
+		log.Printf("Backfilled %d Gemini history entries", len(entries))
+	}
+	return nil
+}
+
+func lookupMember(s *discordgo.Session, guildID, userID string) *discordgo.Member {
+	if member, err := s.State.Member(guildID, userID); err == nil {
+		return member
+	}
+	member, err := s.GuildMember(guildID, userID)
+	if err != nil {
+		return nil
+	}
+	return member
+}
+
+// queueInsertHistoryEntry stores a new history entry. geminiMu must be held.
+func queueInsertHistoryEntry(channelID string, e historyEntry) {
+	c := snapshotContent(e.content)
+	queueHistoryWrite(func(ctx context.Context) error {
+		return insertHistoryEntry(ctx, channelID, e.msgID, e.seq, c)
+	})
+}
+
+// queueUpdateHistoryEntry stores the current content of a history entry.
+// geminiMu must be held.
+func queueUpdateHistoryEntry(e historyEntry) {
+	c := snapshotContent(e.content)
+	queueHistoryWrite(func(ctx context.Context) error {
+		return updateHistoryEntry(ctx, e.seq, c)
+	})
+}
+
+// queueDeleteHistoryEntries deletes history entries. geminiMu must be held.
+func queueDeleteHistoryEntries(entries []historyEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	seqs := make([]int64, len(entries))
+	for n, e := range entries {
+		seqs[n] = e.seq
+	}
+	queueHistoryWrite(func(ctx context.Context) error {
+		_, err := database.Pool.Exec(ctx, `DELETE FROM gemini_history WHERE seq = ANY($1)`, seqs)
+		return err
+	})
+}
+
+// queueClearHistory deletes a channel's stored history. geminiMu must be held,
+// and the history map cleared under the same lock.
+func queueClearHistory(channelID string) {
+	queueHistoryWrite(func(ctx context.Context) error {
+		return clearHistoryEntries(ctx, channelID)
+	})
+}
+
+func insertHistoryEntry(ctx context.Context, channelID, msgID string, seq int64, c *genai.Content) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	var mID *int64
+	if msgID != "" {
+		id, err := strconv.ParseInt(msgID, 10, 64)
+		if err != nil {
+			return err
+		}
+		mID = &id
+	}
+	data, err := encodeContent(c)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `
+		INSERT INTO gemini_history (channel_id, message_id, seq, content)
+		VALUES ($1, $2, $3, $4)
+	`, cID, mID, seq, data)
+	return err
+}
+
+func updateHistoryEntry(ctx context.Context, seq int64, c *genai.Content) error {
+	data, err := encodeContent(c)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `UPDATE gemini_history SET content = $1 WHERE seq = $2`, data, seq)
+	return err
+}
+
+func clearHistoryEntries(ctx context.Context, channelID string) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `DELETE FROM gemini_history WHERE channel_id = $1`, cID)
+	return err
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+)
+
+const (
+	imagineTimeout       = 3 * time.Minute
+	maxImaginePromptLine = 200 // of the prompt quoted above the images
+)
+
+// imagineRequest is what the Reroll button needs to generate the images again.
+type imagineRequest struct {
+	requesterID string
+	prompt      string
+	aspect      string
+	size        string
+	count       int
+}
+
+var (
+	imaginesMu   sync.Mutex                    // guards imagines and imagineOrder
+	imagines     = map[string]imagineRequest{} // followup message ID -> request
+	imagineOrder []string
+)
+
+func init() {
+	registerCommandHandler("imagine", imagineCommandHandler)
+	registerComponentHandler("imagineReroll", imagineRerollHandler)
+}
+
+func imagineCommandHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	req := imagineRequest{aspect: "1:1", size: "1K", count: 1}
+	if i.Member != nil {
+		req.requesterID = i.Member.User.ID
+	} else if i.User != nil {
+		req.requesterID = i.User.ID
+	}
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "prompt":
+			req.prompt = option.StringValue()
+		case "aspect":
+			req.aspect = option.StringValue()
+		case "size":
+			req.size = option.StringValue()
+		case "count":
+			req.count = int(option.IntValue())
+		}
+	}
+	imagine(s, i, req)
+}
+
+// imagine generates images for a request in answer to an interaction, as a
+// followup with a Reroll button. It uses none of the caller's settings or
+// the channel's history.
+func imagine(s *discordgo.Session, i *discordgo.InteractionCreate, req imagineRequest) {
+	imagineModel := imageModel()
+	// Deferred first, since reserving the quota can take a while.
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	// A request is reserved for each image.
+	reservations, quotaRefusal := reserveQuota(s, i.ChannelID, req.requesterID, imagineModel, req.count)
+	if quotaRefusal != "" {
+		// Only the requester sees the refusal, in place of the deferred
+		// response.
+		if err := s.InteractionResponseDelete(i.Interaction); err != nil {
+			log.Println("Error deleting deferred response", err)
+		}
+		_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+			Content: quotaRefusal,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		})
+		if err != nil {
+			log.Println("Error sending message", err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), imagineTimeout)
+	defer cancel()
+	startTime := time.Now()
+	config := &genai.GenerateContentConfig{
+		SafetySettings: safetySettings,
+		ImageConfig:    &genai.ImageConfig{AspectRatio: req.aspect, ImageSize: req.size},
+	}
+	if info, _ := getModel(imagineModel); len(info.thinkingLevels) > 0 {
+		config.ThinkingConfig = &genai.ThinkingConfig{ThinkingLevel: info.thinkingLevels[0]}
+	}
+	contents := []*genai.Content{genai.NewContentFromText(req.prompt, genai.RoleUser)}
+
+	// Each request makes one image, so a count of them run side by side.
+	var wg sync.WaitGroup
+	results := make([]*genai.GenerateContentResponse, req.count)
+	errs := make([]error, req.count)
+	for n := range req.count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reservation int64
+			if n < len(reservations) {
+				reservation = reservations[n]
+			}
+			results[n], errs[n] = generateContentWithRetry(ctx, imagineModel, contents, config)
+			if errs[n] != nil {
+				// A failed image doesn't count against the quota.
+				if reservation != 0 {
+					releaseQuota([]int64{reservation})
+				}
+				return
+			}
+			usage := &usageTotals{}
+			usage.add(results[n])
+			if err := recordUsage(context.Background(), s, i.ChannelID, req.requesterID, imagineModel, reservation, usage); err != nil {
+				log.Println("Error recording Gemini usage", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var files []*discordgo.File
+	var refusal string // text the model answered with instead of an image
+	var firstErr error
+	for n, res := range results {
+		if errs[n] != nil {
+			log.Println("Error generating image", errs[n])
+			if firstErr == nil {
+				firstErr = errs[n]
+			}
+			continue
+		}
+		text, resFiles, _ := extractResponse(res, imagineModel)
+		files = append(files, resFiles...)
+		if text = strings.TrimSpace(text); text != "" && len(resFiles) == 0 && refusal == "" {
+			refusal = text
+		}
+	}
+	for n, f := range files {
+		f.Name = fmt.Sprintf("image-%d%s", n+1, fileExtension(f.ContentType))
+	}
+
+	prompt := strings.Join(strings.Fields(req.prompt), " ")
+	if len(prompt) > maxImaginePromptLine {
+		prompt = strings.ToValidUTF8(prompt[:maxImaginePromptLine], "") + "…"
+	}
+	content := fmt.Sprintf("-# 💡 %.1fs    🤖 %s    📐 %s    🖼️ %s\n> %s", time.Since(startTime).Seconds(), imagineModel, req.aspect, req.size, prompt)
+	switch {
+	case len(files) == 0 && refusal != "":
+		content += "\n" + refusal
+	case len(files) == 0 && firstErr != nil:
+		content += "\n" + firstErr.Error()
+	case len(files) == 0:
+		content += "\nNo images were generated"
+	case len(files) < req.count:
+		content += fmt.Sprintf("\n-# Only %d of %d images were generated", len(files), req.count)
+	}
+	content = getValidString(content, maxMsgLength)
+
+	msg, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+		Content:         content,
+		Files:           files,
+		Components:      imagineComponents(),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		log.Println("Error sending images", err)
+		return
+	}
+	trackImagine(msg.ID, req)
+}
+
+func imagineComponents() []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Reroll",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "imagineReroll",
+					Emoji:    &discordgo.ComponentEmoji{Name: "🎲"},
+				},
+			},
+		},
+	}
+}
+
+// trackImagine remembers a request so it can be rerolled. Like responses, only
+// the most recent maxTrackedResponses are kept.
+func trackImagine(msgID string, req imagineRequest) {
+	imaginesMu.Lock()
+	defer imaginesMu.Unlock()
+	imagines[msgID] = req
+	imagineOrder = append(imagineOrder, msgID)
+	if len(imagineOrder) > maxTrackedResponses {
+		delete(imagines, imagineOrder[0])
+		imagineOrder = imagineOrder[1:]
+	}
+}
+
+func imagineRerollHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	imaginesMu.Lock()
+	req, ok := imagines[i.Message.ID]
+	imaginesMu.Unlock()
+	if !ok {
+		respondEphemeral(s, i, "These images can no longer be rerolled")
+		return
+	}
+	if !canControlResponse(i, req.requesterID) {
+		respondEphemeral(s, i, "Only the person who asked or a moderator can reroll these images")
+		return
+	}
+	imagine(s, i, req)
+}
@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/clients"
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const (
+	mediaUploadsSchema = `
+		CREATE TABLE IF NOT EXISTS gemini_media_uploads (
+			hash       text        PRIMARY KEY,
+			uri        text        NOT NULL,
+			expires_at timestamptz NOT NULL
+		);
+	`
+
+	defaultMediaCacheBytes = 1 << 30
+	maxMediaFileBytes      = 50 << 20
+	mediaFetchTimeout      = 30 * time.Second
+
+	// Larger files are uploaded through the Files API instead of being sent
+	// inline with every request.
+	maxInlineMediaBytes = 4 << 20
+	mediaUploadTimeout  = 2 * time.Minute
+	// Uploaded files expire after 48 hours; re-upload well before that.
+	mediaUploadLifetime = 47 * time.Hour
+)
+
+// cachedMedia is a file in the media cache, named by the SHA-256 of its
+// contents.
+type cachedMedia struct {
+	hash string
+	size int64
+	urls []string // mediaURLs keys of the file
+}
+
+type fetchedMedia struct {
+	hash     string
+	mimeType string
+}
+
+type uploadedMedia struct {
+	uri     string
+	expires time.Time
+}
+
+var (
+	mediaCacheMu    sync.Mutex
+	mediaLRU        = list.New()                 // of *cachedMedia, most recently used first
+	mediaFiles      = map[string]*list.Element{} // hash -> element of mediaLRU
+	mediaCacheSize  int64
+	mediaURLs       = map[string]fetchedMedia{}  // mediaURLKey -> contents, of cached files only
+	mediaUploads    = map[string]uploadedMedia{} // hash -> Files API upload, of cached files only
+	mediaCacheDir   = os.Getenv("GEMINI_MEDIA_CACHE_DIR")
+	maxMediaCache   = int64(defaultMediaCacheBytes)
+	mediaHTTPClient = &http.Client{Timeout: mediaFetchTimeout}
+
+	mediaHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+func init() {
+	if mediaCacheDir == "" {
+		mediaCacheDir = filepath.Join(os.TempDir(), "gemini-media")
+	}
+	if v := os.Getenv("GEMINI_MEDIA_CACHE_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxMediaCache = n
+		} else {
+			log.Println("Invalid GEMINI_MEDIA_CACHE_BYTES", v)
+		}
+	}
+	if err := loadMediaCache(); err != nil {
+		log.Println("Error loading media cache", err)
+	}
+	if _, err := database.Pool.Exec(context.Background(), mediaUploadsSchema); err != nil {
+		log.Println("Error creating media uploads table", err)
+	}
+	if err := loadMediaUploads(context.Background()); err != nil {
+		log.Println("Error loading media uploads", err)
+	}
+}
+
+// loadMediaCache indexes the files left in the cache directory by an earlier
+// run, least recently used last.
+func loadMediaCache() error {
+	if err := os.MkdirAll(mediaCacheDir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(mediaCacheDir)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		cachedMedia
+		used time.Time
+	}
+	var files []file
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !mediaHashRegexp.MatchString(e.Name()) {
+			continue
+		}
+		files = append(files, file{cachedMedia{hash: e.Name(), size: info.Size()}, info.ModTime()})
+	}
+	slices.SortFunc(files, func(a, b file) int { return b.used.Compare(a.used) })
+
+	mediaCacheMu.Lock()
+	defer mediaCacheMu.Unlock()
+	for _, f := range files {
+		mediaFiles[f.hash] = mediaLRU.PushBack(&f.cachedMedia)
+		mediaCacheSize += f.size
+	}
+	evictMedia()
+	return nil
+}
+
+// loadMediaUploads loads the uploads of cached files that are still valid, so
+// they aren't uploaded again after a restart, and forgets expired ones.
+func loadMediaUploads(ctx context.Context) error {
+	if _, err := database.Pool.Exec(ctx, `DELETE FROM gemini_media_uploads WHERE expires_at <= now()`); err != nil {
+		return err
+	}
+	rows, err := database.Pool.Query(ctx, `SELECT hash, uri, expires_at FROM gemini_media_uploads`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	mediaCacheMu.Lock()
+	defer mediaCacheMu.Unlock()
+	for rows.Next() {
+		var hash string
+		var up uploadedMedia
+		if err := rows.Scan(&hash, &up.uri, &up.expires); err != nil {
+			return err
+		}
+		if _, ok := mediaFiles[hash]; ok {
+			mediaUploads[hash] = up
+		}
+	}
+	return rows.Err()
+}
+
+// evictMedia removes the least recently used files until the cache fits in
+// maxMediaCache, along with what is known about their URLs and uploads.
+// mediaCacheMu must be held.
+func evictMedia() {
+	for mediaCacheSize > maxMediaCache && mediaLRU.Len() > 0 {
+		cm := mediaLRU.Remove(mediaLRU.Back()).(*cachedMedia)
+		delete(mediaFiles, cm.hash)
+		delete(mediaUploads, cm.hash)
+		for _, key := range cm.urls {
+			delete(mediaURLs, key)
+		}
+		mediaCacheSize -= cm.size
+		if err := os.Remove(filepath.Join(mediaCacheDir, cm.hash)); err != nil && !os.IsNotExist(err) {
+			log.Println("Error evicting cached media", err)
+		}
+	}
+}
+
+// readCachedMedia returns a cached file's contents and marks it as recently
+// used, or nil if it isn't cached.
+func readCachedMedia(hash string) []byte {
+	mediaCacheMu.Lock()
+	elem, ok := mediaFiles[hash]
+	if ok {
+		mediaLRU.MoveToFront(elem)
+	}
+	mediaCacheMu.Unlock()
+	if !ok {
+		return nil
+	}
+	path := filepath.Join(mediaCacheDir, hash)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("Error reading cached media", err)
+		return nil
+	}
+	// The modification time keeps the LRU order across restarts.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data
+}
+
+func writeCachedMedia(hash string, data []byte) error {
+	mediaCacheMu.Lock()
+	_, ok := mediaFiles[hash]
+	mediaCacheMu.Unlock()
+	if ok {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(mediaCacheDir, "fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(mediaCacheDir, hash)); err != nil {
+		return err
+	}
+
+	mediaCacheMu.Lock()
+	defer mediaCacheMu.Unlock()
+	if _, ok := mediaFiles[hash]; !ok {
+		mediaFiles[hash] = mediaLRU.PushFront(&cachedMedia{hash: hash, size: int64(len(data))})
+		mediaCacheSize += int64(len(data))
+		evictMedia()
+	}
+	return nil
+}
+
+// mediaURLKey identifies the file behind a URL. Discord CDN links carry a
+// signature in their query that changes every day, so it is dropped.
+func mediaURLKey(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	switch u.Host {
+	case "cdn.discordapp.com", "media.discordapp.net":
+		u.RawQuery = ""
+	}
+	return u.String()
+}
+
+// downloadMedia fetches a URL, or reads it from the media cache if it was
+// fetched before. It returns the contents' hash and MIME type.
+func downloadMedia(url, contentType string) ([]byte, fetchedMedia, error) {
+	key := mediaURLKey(url)
+	mediaCacheMu.Lock()
+	fm, ok := mediaURLs[key]
+	mediaCacheMu.Unlock()
+	if ok {
+		if data := readCachedMedia(fm.hash); data != nil {
+			return data, fm, nil
+		}
+	}
+
+	resp, err := mediaHTTPClient.Get(url)
+	if err != nil {
+		return nil, fetchedMedia{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fetchedMedia{}, fmt.Errorf("fetching media: %s", resp.Status)
+	}
+	if resp.ContentLength > maxMediaFileBytes {
+		return nil, fetchedMedia{}, fmt.Errorf("media is larger than %d MB", maxMediaFileBytes>>20)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMediaFileBytes+1))
+	if err != nil {
+		return nil, fetchedMedia{}, err
+	}
+	if len(data) > maxMediaFileBytes {
+		return nil, fetchedMedia{}, fmt.Errorf("media is larger than %d MB", maxMediaFileBytes>>20)
+	}
+	if contentType == "" {
+		contentType = resp.Header.Get("Content-Type")
+	}
+	// A missing or malformed type is guessed later by normalizeMediaType.
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	sum := sha256.Sum256(data)
+	fm = fetchedMedia{hash: hex.EncodeToString(sum[:]), mimeType: mediaType}
+	if err := writeCachedMedia(fm.hash, data); err != nil {
+		log.Println("Error caching media", err)
+	}
+	// Only cached files are remembered, so the URLs go with them when they
+	// are evicted.
+	mediaCacheMu.Lock()
+	if elem, ok := mediaFiles[fm.hash]; ok {
+		if _, ok := mediaURLs[key]; !ok {
+			cm := elem.Value.(*cachedMedia)
+			cm.urls = append(cm.urls, key)
+		}
+		mediaURLs[key] = fm
+	}
+	mediaCacheMu.Unlock()
+	return data, fm, nil
+}
+
+func fetchMedia(url, contentType, filename string) (*genai.Part, error) {
+	data, fm, err := downloadMedia(url, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return attachmentPart(context.Background(), data, fm, filename)
+}
+
+// mediaPart references large files through the Files API and inlines the
+// rest, or everything if the client's backend has no Files API.
+func mediaPart(ctx context.Context, data []byte, fm fetchedMedia) *genai.Part {
+	if len(data) > maxInlineMediaBytes && canUploadMedia() {
+		uri, err := uploadMedia(ctx, data, fm)
+		if err == nil {
+			// The display name keeps the hash so the file can be re-uploaded
+			// from the cache once the upload expires.
+			return &genai.Part{FileData: &genai.FileData{FileURI: uri, MIMEType: fm.mimeType, DisplayName: fm.hash}}
+		}
+		log.Println("Error uploading media, sending it inline", err)
+	}
+	return genai.NewPartFromBytes(data, fm.mimeType)
+}
+
+func canUploadMedia() bool {
+	return clients.GeminiClient.ClientConfig().Backend == genai.BackendGeminiAPI
+}
+
+// uploadMedia uploads a file through the Files API, reusing an earlier upload
+// of the same contents while it is still valid.
+func uploadMedia(ctx context.Context, data []byte, fm fetchedMedia) (string, error) {
+	mediaCacheMu.Lock()
+	up, ok := mediaUploads[fm.hash]
+	mediaCacheMu.Unlock()
+	if ok && time.Now().Before(up.expires) {
+		return up.uri, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mediaUploadTimeout)
+	defer cancel()
+	uploadedAt := time.Now()
+	file, err := clients.GeminiClient.Files.Upload(ctx, bytes.NewReader(data), &genai.UploadFileConfig{MIMEType: fm.mimeType, DisplayName: fm.hash})
+	if err != nil {
+		return "", err
+	}
+	// Videos and PDFs have to be processed before they can be used.
+	for file.State == genai.FileStateProcessing {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		if file, err = clients.GeminiClient.Files.Get(ctx, file.Name, nil); err != nil {
+			return "", err
+		}
+	}
+	if file.State == genai.FileStateFailed {
+		return "", fmt.Errorf("processing %s failed", file.Name)
+	}
+
+	up = uploadedMedia{uri: file.URI, expires: uploadedAt.Add(mediaUploadLifetime)}
+	mediaCacheMu.Lock()
+	if _, ok := mediaFiles[fm.hash]; ok {
+		mediaUploads[fm.hash] = up
+	}
+	mediaCacheMu.Unlock()
+	// Stored so a restart doesn't upload every file in history again.
+	_, err = database.Pool.Exec(context.Background(), `
+		INSERT INTO gemini_media_uploads (hash, uri, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (hash) DO UPDATE SET uri = excluded.uri, expires_at = excluded.expires_at
+	`, fm.hash, up.uri, up.expires)
+	if err != nil {
+		log.Println("Error storing media upload", err)
+	}
+	return file.URI, nil
+}
+
+// refreshMedia returns contents with every uploaded file pointing at a valid
+// upload. Files whose upload expired, and media that history loaded from the
+// database refers to by hash, are uploaded again from the media cache or
+// inlined; files that left the cache are replaced by a note.
+// contents itself is not modified, since it is shared with history.
+func refreshMedia(ctx context.Context, contents []*genai.Content) []*genai.Content {
+	var refreshed []*genai.Content
+	for i, c := range contents {
+		var parts []*genai.Part
+		for j, p := range c.Parts {
+			if p == nil || p.FileData == nil || !mediaHashRegexp.MatchString(p.FileData.DisplayName) {
+				continue
+			}
+			fresh := refreshFileData(ctx, p.FileData)
+			if fresh == nil {
+				continue
+			}
+			if parts == nil {
+				parts = slices.Clone(c.Parts)
+			}
+			// Keep the rest of the part, such as a thought signature.
+			merged := *p
+			merged.Text, merged.InlineData, merged.FileData = fresh.Text, fresh.InlineData, fresh.FileData
+			parts[j] = &merged
+		}
+		if parts == nil {
+			continue
+		}
+		if refreshed == nil {
+			refreshed = slices.Clone(contents)
+		}
+		refreshed[i] = &genai.Content{Role: c.Role, Parts: parts}
+	}
+	if refreshed == nil {
+		return contents
+	}
+	return refreshed
+}
+
+// refreshFileData returns a part to replace fd with, or nil if fd is still
+// valid.
+func refreshFileData(ctx context.Context, fd *genai.FileData) *genai.Part {
+	fm := fetchedMedia{hash: fd.DisplayName, mimeType: fd.MIMEType}
+	mediaCacheMu.Lock()
+	up, ok := mediaUploads[fm.hash]
+	mediaCacheMu.Unlock()
+	if ok && time.Now().Before(up.expires) {
+		if up.uri == fd.FileURI {
+			return nil
+		}
+		return &genai.Part{FileData: &genai.FileData{FileURI: up.uri, MIMEType: fd.MIMEType, DisplayName: fd.DisplayName}}
+	}
+	data := readCachedMedia(fm.hash)
+	if data == nil {
+		return genai.NewPartFromText(fmt.Sprintf("[%s attachment expired]", fd.MIMEType))
+	}
+	return mediaPart(ctx, data, fm)
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+)
+
+const (
+	defaultChannelRange = 20
+	maxChannelRange     = 50
+	maxReplyChain       = 5 // earlier replies returned by read_discord_message
+)
+
+var (
+	messageLinkRegexp = regexp.MustCompile(`discord(?:app)?\.com/channels/(?:\d+|@me)/(\d+)(?:/(\d+))?`)
+	snowflakeRegexp   = regexp.MustCompile(`^\d{15,21}$`)
+
+	readDiscordMessageFuncDeclaration = &genai.FunctionDeclaration{
+		Name: "read_discord_message",
+		Description: `Reads a single Discord message by its link (https://discord.com/channels/<guild>/<channel>/<message>) or ID.
+Use this when someone pastes a message link or refers to a specific message you don't have in the chat log.
+Returns the message formatted like the chat log (timestamp, author, the message it replies to, and content), its attachments, and its link.
+If the message it replies to is itself a reply, reply_chain quotes the earlier messages of the conversation, nearest first.
+Only channels that both you and the person asking can read are available.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"message": {
+					Type:        genai.TypeString,
+					Description: "Message link or message ID",
+				},
+				"channel_id": {
+					Type:        genai.TypeString,
+					Description: "If the message is given by ID, the ID of its channel; defaults to the current channel",
+				},
+			},
+			Required: []string{"message"},
+		},
+	}
+
+	readChannelRangeFuncDeclaration = &genai.FunctionDeclaration{
+		Name: "read_channel_range",
+		Description: `Reads consecutive messages from a Discord channel, oldest first.
+Use this to see the context around a message link, or to read recent messages in another channel.
+Give at most one of before, after or around; without any of them the most recent messages are returned.
+Each message is formatted like the chat log (timestamp, author, the message it replies to, and content), with its attachments and link.
+Only channels that both you and the person asking can read are available.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"channel": {
+					Type:        genai.TypeString,
+					Description: "Channel link, channel ID, or a message link in the channel; defaults to the current channel",
+				},
+				"before": {
+					Type:        genai.TypeString,
+					Description: "If set, return messages sent before this message link or ID",
+				},
+				"after": {
+					Type:        genai.TypeString,
+					Description: "If set, return messages sent after this message link or ID",
+				},
+				"around": {
+					Type:        genai.TypeString,
+					Description: "If set, return messages sent around this message link or ID",
+				},
+				"limit": {
+					Type:        genai.TypeInteger,
+					Description: fmt.Sprintf("If set, the number of messages to return, at most %d; defaults to %d", maxChannelRange, defaultChannelRange),
+				},
+			},
+		},
+	}
+)
+
+func init() {
+	registerTool(tool{declaration: readDiscordMessageFuncDeclaration, handler: readDiscordMessageHandler})
+	registerTool(tool{declaration: readChannelRangeFuncDeclaration, handler: readChannelRangeHandler})
+}
+
+// parseMessageRef extracts a channel and message ID from a message link or a
+// bare ID. The channel is empty if only an ID was given.
+func parseMessageRef(ref string) (channelID, msgID string, err error) {
+	ref = strings.TrimSpace(ref)
+	if match := messageLinkRegexp.FindStringSubmatch(ref); match != nil {
+		if match[2] == "" {
+			return "", "", fmt.Errorf("%q links to a channel, not a message", ref)
+		}
+		return match[1], match[2], nil
+	}
+	if snowflakeRegexp.MatchString(ref) {
+		return "", ref, nil
+	}
+	return "", "", fmt.Errorf("%q is not a Discord link or ID", ref)
+}
+
+// checkReadable returns an error unless both the requester and the bot can
+// read the message history of channelID. The current channel is always
+// readable, which also covers DMs. A private thread is only readable by its
+// members and by those who can manage threads.
+func checkReadable(s *discordgo.Session, scope toolScope, channelID string) error {
+	if channelID == scope.channelID {
+		return nil
+	}
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		if ch, err = s.Channel(channelID); err != nil {
+			return errors.New("channel not found or not visible to the bot")
+		}
+	}
+	if ch.GuildID == "" {
+		return errors.New("only server channels can be read")
+	}
+	// Threads don't have their own overwrites, so the parent decides, except
+	// that private threads are hidden from everyone else.
+	permChannelID := ch.ID
+	if ch.IsThread() {
+		permChannelID = ch.ParentID
+	}
+	const need = discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory
+	for _, userID := range []string{scope.requesterID, s.State.User.ID} {
+		perms, err := s.UserChannelPermissions(userID, permChannelID)
+		if err != nil || perms&need != need {
+			if userID == scope.requesterID {
+				return errors.New("the person asking can't read that channel")
+			}
+			return errors.New("the bot can't read that channel")
+		}
+		if ch.Type == discordgo.ChannelTypeGuildPrivateThread && userID == scope.requesterID && perms&discordgo.PermissionManageThreads == 0 {
+			if _, err := s.ThreadMember(ch.ID, userID, false); err != nil {
+				return errors.New("the person asking isn't in that private thread")
+			}
+		}
+	}
+	return nil
+}
+
+// formatToolMessage formats a message like the chat log, followed by its
+// attachments and link.
+func formatToolMessage(s *discordgo.Session, m *discordgo.Message, members map[string]*discordgo.Member) (map[string]any, error) {
+	if m.Member == nil && m.GuildID != "" {
+		member, ok := members[m.Author.ID]
+		if !ok {
+			member = lookupMember(s, m.GuildID, m.Author.ID)
+			members[m.Author.ID] = member
+		}
+		m.Member = member
+	}
+	header, err := formatMessageHeader(s, m)
+	if err != nil {
+		return nil, err
+	}
+	var atts []string
+	for _, att := range m.Attachments {
+		atts = append(atts, fmt.Sprintf("%s (%s) %s", att.Filename, att.ContentType, att.URL))
+	}
+	guild := m.GuildID
+	if guild == "" {
+		guild = "@me"
+	}
+	res := map[string]any{
+		"message": header,
+		"link":    fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guild, m.ChannelID, m.ID),
+	}
+	if len(atts) > 0 {
+		res["attachments"] = atts
+	}
+	return res, nil
+}
+
+// replyChain quotes the messages that m's replied-to message replies to in
+// turn, nearest first and at most maxReplyChain of them. The replied-to message
+// itself is already in m's header.
+func replyChain(s *discordgo.Session, m *discordgo.Message) []string {
+	var chain []string
+	ref := referencedMessage(s, m)
+	for ref != nil && len(chain) < maxReplyChain {
+		if ref = referencedMessage(s, ref); ref == nil || ref.Author == nil {
+			break
+		}
+		quoted, err := formatQuotedMessage(s, ref)
+		if err != nil {
+			log.Println("Error formatting referenced message", err)
+			break
+		}
+		chain = append(chain, quoted)
+	}
+	return chain
+}
+
+func toolMessageSource(m *discordgo.Message, link string) toolSource {
+	mTime, _ := discordgo.SnowflakeTimestamp(m.ID)
+	return toolSource{Label: sourceLabel(mTime, m.Content), URL: link}
+}
+
+func readDiscordMessageHandler(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+	ref, _ := args["message"].(string)
+	channelID, msgID, err := parseMessageRef(ref)
+	if err != nil {
+		return toolResult{}, err
+	}
+	if channelID == "" {
+		channelID, _ = args["channel_id"].(string)
+	}
+	if channelID == "" {
+		channelID = scope.channelID
+	}
+	if err := checkReadable(scope.s, scope, channelID); err != nil {
+		return toolResult{}, err
+	}
+
+	m, err := scope.s.ChannelMessage(channelID, msgID, discordgo.WithContext(ctx))
+	if err != nil {
+		return toolResult{}, fmt.Errorf("couldn't fetch the message: %w", err)
+	}
+	if m.GuildID == "" {
+		if ch, err := scope.s.State.Channel(channelID); err == nil {
+			m.GuildID = ch.GuildID
+		}
+	}
+	out, err := formatToolMessage(scope.s, m, map[string]*discordgo.Member{})
+	if err != nil {
+		return toolResult{}, err
+	}
+	if chain := replyChain(scope.s, m); len(chain) > 0 {
+		out["reply_chain"] = chain
+	}
+	return toolResult{output: out, rows: 1, sources: []toolSource{toolMessageSource(m, out["link"].(string))}}, nil
+}
+
+func readChannelRangeHandler(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+	channelID := scope.channelID
+	if ref, _ := args["channel"].(string); ref != "" {
+		if match := messageLinkRegexp.FindStringSubmatch(ref); match != nil {
+			channelID = match[1]
+		} else if snowflakeRegexp.MatchString(strings.TrimSpace(ref)) {
+			channelID = strings.TrimSpace(ref)
+		} else {
+			return toolResult{}, fmt.Errorf("%q is not a Discord link or ID", ref)
+		}
+	}
+	if err := checkReadable(scope.s, scope, channelID); err != nil {
+		return toolResult{}, err
+	}
+
+	var anchors [3]string // before, after, around
+	for i, key := range []string{"before", "after", "around"} {
+		ref, _ := args[key].(string)
+		if ref == "" {
+			continue
+		}
+		_, msgID, err := parseMessageRef(ref)
+		if err != nil {
+			return toolResult{}, err
+		}
+		anchors[i] = msgID
+	}
+	limit := defaultChannelRange
+	if v, ok := args["limit"].(float64); ok && int(v) > 0 {
+		limit = min(int(v), maxChannelRange)
+	}
+
+	msgs, err := scope.s.ChannelMessages(channelID, limit, anchors[0], anchors[1], anchors[2], discordgo.WithContext(ctx))
+	if err != nil {
+		return toolResult{}, fmt.Errorf("couldn't fetch messages: %w", err)
+	}
+	guildID := ""
+	if ch, err := scope.s.State.Channel(channelID); err == nil {
+		guildID = ch.GuildID
+	}
+
+	// Discord returns the newest message first.
+	members := map[string]*discordgo.Member{}
+	var out []map[string]any
+	var sources []toolSource
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		if m.GuildID == "" {
+			m.GuildID = guildID
+		}
+		formatted, err := formatToolMessage(scope.s, m, members)
+		if err != nil {
+			continue
+		}
+		out = append(out, formatted)
+		if len(sources) < maxSourcesPerCall {
+			sources = append(sources, toolMessageSource(m, formatted["link"].(string)))
+		}
+	}
+	return toolResult{output: out, rows: len(out), sources: sources}, nil
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/clients"
+)
+
+const (
+	modelRefreshInterval = 24 * time.Hour
+	maxModelChoices      = 25 // Discord's limit for autocomplete choices
+
+	// Requests per user per day to a model added by refreshModels, until it is
+	// configured in GEMINI_MODELS_FILE.
+	discoveredDailyRequests = 25
+)
+
+// modelConfig is a model's entry in the GEMINI_MODELS_FILE JSON array. An
+// entry replaces the built-in model of the same name, and a retired entry
+// removes it and keeps it from being added by a refresh.
+type modelConfig struct {
+	Name             string   `json:"name"`
+	DisplayName      string   `json:"display_name"`
+	ThinkingLevels   []string `json:"thinking_levels"`
+	ImageOutput      bool     `json:"image_output"`
+	Tools            *bool    `json:"tools"` // defaults to true for models without image output
+	InputTokenLimit  int32    `json:"input_token_limit"`
+	OutputTokenLimit int32    `json:"output_token_limit"`
+	InputPrice       float64  `json:"input_price"`
+	OutputPrice      float64  `json:"output_price"`
+	DailyRequests    int      `json:"daily_requests"`
+	Retired          bool     `json:"retired"`
+}
+
+var (
+	allThinkingLevels = []genai.ThinkingLevel{genai.ThinkingLevelMinimal, genai.ThinkingLevelLow, genai.ThinkingLevelMedium, genai.ThinkingLevelHigh}
+
+	builtinModels = map[string]modelInfo{
+		"gemini-3.5-flash":       {displayName: "Gemini 3.5 Flash", tools: true, inputTokenLimit: 1048576, inputPrice: 0.5, outputPrice: 3, thinkingLevels: allThinkingLevels},
+		"gemini-3.1-pro-preview": {displayName: "Gemini 3.1 Pro", tools: true, inputTokenLimit: 1048576, inputPrice: 2, outputPrice: 12, dailyRequests: 50, thinkingLevels: []genai.ThinkingLevel{genai.ThinkingLevelLow, genai.ThinkingLevelMedium, genai.ThinkingLevelHigh}},
+		"gemini-3-flash-preview": {displayName: "Gemini 3 Flash", tools: true, inputTokenLimit: 1048576, inputPrice: 0.5, outputPrice: 3, thinkingLevels: allThinkingLevels},
+		"gemini-3.1-flash-image": {displayName: "Gemini 3.1 Flash Image", imageOutput: true, inputTokenLimit: 131072, inputPrice: 0.5, outputPrice: 60, dailyRequests: 25, thinkingLevels: []genai.ThinkingLevel{genai.ThinkingLevelMinimal, genai.ThinkingLevelHigh}},
+	}
+
+	modelsMu         sync.Mutex // guards models, retiredModels and configuredModels
+	models           = maps.Clone(builtinModels)
+	retiredModels    = map[string]bool{}
+	configuredModels = map[string]bool{} // models from GEMINI_MODELS_FILE, whose limits a refresh keeps
+	modelsOnce       sync.Once
+)
+
+func init() {
+	if file := os.Getenv("GEMINI_MODELS_FILE"); file != "" {
+		if err := loadModelsFile(file); err != nil {
+			log.Println("Error loading Gemini models file", err)
+		}
+	}
+	registerReadyHandler(modelsReadyHandler)
+	registerAutocompleteHandler("gemini", geminiAutocompleteHandler)
+}
+
+// getModel returns what is known about a model, and whether it is available.
+func getModel(name string) (modelInfo, bool) {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	info, ok := models[name]
+	return info, ok
+}
+
+// listModels returns the names of the available models: the built-in and
+// configured ones first, then those added by refreshModels, each in reverse
+// order of name, which puts later versions of a model first.
+func listModels() []string {
+	modelsMu.Lock()
+	names := make([]string, 0, len(models))
+	for name := range models {
+		names = append(names, name)
+	}
+	discovered := func(name string) bool { return models[name].discovered }
+	slices.SortFunc(names, func(a, b string) int {
+		if discovered(a) != discovered(b) {
+			if discovered(a) {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(b, a)
+	})
+	modelsMu.Unlock()
+	return names
+}
+
+func loadModelsFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var configs []modelConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	for _, mc := range configs {
+		if mc.Name == "" {
+			continue
+		}
+		if mc.Retired {
+			delete(models, mc.Name)
+			retiredModels[mc.Name] = true
+			continue
+		}
+		info := modelInfo{
+			displayName:      mc.DisplayName,
+			imageOutput:      mc.ImageOutput,
+			tools:            !mc.ImageOutput,
+			inputTokenLimit:  mc.InputTokenLimit,
+			outputTokenLimit: mc.OutputTokenLimit,
+			inputPrice:       mc.InputPrice,
+			outputPrice:      mc.OutputPrice,
+			dailyRequests:    mc.DailyRequests,
+		}
+		if mc.Tools != nil {
+			info.tools = *mc.Tools
+		}
+		for _, level := range mc.ThinkingLevels {
+			info.thinkingLevels = append(info.thinkingLevels, genai.ThinkingLevel(strings.ToUpper(level)))
+		}
+		models[mc.Name] = info
+		configuredModels[mc.Name] = true
+	}
+	log.Printf("Loaded %d Gemini model(s) from %s", len(configs), file)
+	return nil
+}
+
+// modelsReadyHandler refreshes the models from the API now and then.
+func modelsReadyHandler(s *discordgo.Session, r *discordgo.Ready) {
+	modelsOnce.Do(func() {
+		go func() {
+			for {
+				if err := refreshModels(context.Background()); err != nil {
+					log.Println("Error refreshing Gemini models", err)
+				}
+				time.Sleep(modelRefreshInterval)
+			}
+		}()
+	})
+}
+
+// refreshModels updates the token limits of known models from the API, except
+// those set in GEMINI_MODELS_FILE, and adds the chat models it doesn't know
+// yet, with conservative capabilities, a default quota and the highest price
+// of the known models, until they are configured in GEMINI_MODELS_FILE. A
+// model missing from the API is only logged, since retiring it would reset
+// everyone's settings; retire it in GEMINI_MODELS_FILE instead.
+func refreshModels(ctx context.Context) error {
+	listed := map[string]*genai.Model{}
+	for m, err := range clients.GeminiClient.Models.All(ctx) {
+		if err != nil {
+			return err
+		}
+		name := path.Base(m.Name)
+		if isChatModel(name, m) {
+			listed[name] = m
+		}
+	}
+	if len(listed) == 0 {
+		return nil
+	}
+
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	var maxPrices modelInfo
+	for _, info := range models {
+		if !info.discovered {
+			maxPrices.inputPrice = max(maxPrices.inputPrice, info.inputPrice)
+			maxPrices.outputPrice = max(maxPrices.outputPrice, info.outputPrice)
+		}
+	}
+	var added []string
+	for name, m := range listed {
+		if retiredModels[name] {
+			continue
+		}
+		info, ok := models[name]
+		if !ok {
+			info = inferModelInfo(name, m)
+			info.inputPrice, info.outputPrice = maxPrices.inputPrice, maxPrices.outputPrice
+			added = append(added, name)
+		}
+		// Limits set in GEMINI_MODELS_FILE win over the API's.
+		if m.InputTokenLimit > 0 && (info.inputTokenLimit == 0 || !configuredModels[name]) {
+			info.inputTokenLimit = m.InputTokenLimit
+		}
+		if m.OutputTokenLimit > 0 && (info.outputTokenLimit == 0 || !configuredModels[name]) {
+			info.outputTokenLimit = m.OutputTokenLimit
+		}
+		if info.displayName == "" {
+			info.displayName = m.DisplayName
+		}
+		models[name] = info
+	}
+	if len(added) > 0 {
+		log.Println("Added Gemini models", added)
+	}
+	for name := range models {
+		if listed[name] == nil {
+			log.Println("Gemini model is no longer listed by the API", name)
+		}
+	}
+	return nil
+}
+
+// isChatModel reports whether a listed model can be chatted with, as opposed
+// to embedding, speech or live models.
+func isChatModel(name string, m *genai.Model) bool {
+	if !strings.HasPrefix(name, "gemini-") {
+		return false
+	}
+	for _, skip := range []string{"embedding", "tts", "live", "native-audio"} {
+		if strings.Contains(name, skip) {
+			return false
+		}
+	}
+	// Vertex AI doesn't report supported actions.
+	return len(m.SupportedActions) == 0 || slices.Contains(m.SupportedActions, "generateContent")
+}
+
+func inferModelInfo(name string, m *genai.Model) modelInfo {
+	info := modelInfo{displayName: m.DisplayName, dailyRequests: discoveredDailyRequests, discovered: true}
+	info.imageOutput = strings.Contains(name, "-image")
+	info.tools = !info.imageOutput
+	// Gemini 2.5 and older think with a token budget rather than levels, and
+	// low and high are the levels every later model supports.
+	if m.Thinking && !strings.HasPrefix(name, "gemini-1") && !strings.HasPrefix(name, "gemini-2") {
+		info.thinkingLevels = []genai.ThinkingLevel{genai.ThinkingLevelLow, genai.ThinkingLevelHigh}
+	}
+	return info
+}
+
+// imageModel returns the model /imagine uses: the default image model, or
+// another one if it was retired, preferring configured models to discovered
+// ones.
+func imageModel() string {
+	const preferred = "gemini-3.1-flash-image"
+	if info, ok := getModel(preferred); ok && info.imageOutput {
+		return preferred
+	}
+	for _, name := range listModels() {
+		if info, _ := getModel(name); info.imageOutput {
+			return name
+		}
+	}
+	return preferred
+}
+
+// focusedOption returns the option a user is typing into.
+func focusedOption(options []*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, option := range options {
+		if option.Focused {
+			return option
+		}
+		if focused := focusedOption(option.Options); focused != nil {
+			return focused
+		}
+	}
+	return nil
+}
+
+// geminiAutocompleteHandler suggests models for /gemini settings model.
+func geminiAutocompleteHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	option := focusedOption(i.ApplicationCommandData().Options)
+	if option == nil || option.Name != "name" {
+		return
+	}
+	query := strings.ToLower(strings.TrimSpace(option.StringValue()))
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, name := range listModels() {
+		info, _ := getModel(name)
+		label := name
+		if info.displayName != "" {
+			label = info.displayName + " (" + name + ")"
+		}
+		if !strings.Contains(strings.ToLower(label), query) {
+			continue
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: getValidString(label, 100), Value: name})
+		if len(choices) == maxModelChoices {
+			break
+		}
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		log.Println("Error responding to autocomplete", err)
+	}
+}
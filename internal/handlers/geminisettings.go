@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const geminiSettingsSchema = `
+	CREATE TABLE IF NOT EXISTS gemini_user_settings (
+		channel_id               bigint  NOT NULL,
+		user_id                  bigint  NOT NULL,
+		model                    text    NOT NULL,
+		thinking_level           text    NOT NULL,
+		search                   boolean NOT NULL,
+		code_execution           boolean NOT NULL,
+		aspect_ratio             text    NOT NULL,
+		image_size               text    NOT NULL,
+		force_markdown_rendering boolean NOT NULL,
+		PRIMARY KEY (channel_id, user_id)
+	);
+	ALTER TABLE gemini_user_settings ADD COLUMN IF NOT EXISTS split_responses boolean NOT NULL DEFAULT false;
+	CREATE TABLE IF NOT EXISTS gemini_channel_settings (
+		channel_id bigint  PRIMARY KEY,
+		summarize  boolean NOT NULL DEFAULT false
+	);
+	ALTER TABLE gemini_channel_settings ADD COLUMN IF NOT EXISTS threads boolean NOT NULL DEFAULT false;
+`
+
+func init() {
+	if _, err := database.Pool.Exec(context.Background(), geminiSettingsSchema); err != nil {
+		log.Println("Error creating Gemini settings table", err)
+	}
+}
+
+func defaultUserSettings() *userSettings {
+	return &userSettings{
+		model:         "gemini-3.5-flash",
+		thinkingLevel: genai.ThinkingLevelMinimal,
+		search:        true,
+		aspectRatio:   "16:9",
+		imageSize:     "1K",
+	}
+}
+
+// settingsUpdateMu serializes updates to user and channel settings, so two
+// updates can't both read the old settings and overwrite each other's change.
+var settingsUpdateMu sync.Mutex
+
+// getUserSettings returns a copy of the user's settings for a channel, or the
+// defaults if they can't be loaded.
+func getUserSettings(channelID, userID string) userSettings {
+	us, err := lookupUserSettings(channelID, userID)
+	if err != nil {
+		log.Println("Error loading Gemini settings", err)
+		return *defaultUserSettings()
+	}
+	return us
+}
+
+// lookupUserSettings returns a copy of the user's settings for a channel. The
+// settings map acts as a write-through cache in front of the database, so
+// only the first lookup per user and channel hits Postgres.
+func lookupUserSettings(channelID, userID string) (userSettings, error) {
+	geminiMu.Lock()
+	us, ok := settings[channelID][userID]
+	geminiMu.Unlock()
+	if ok {
+		return *us, nil
+	}
+
+	// Defaults aren't cached on an error, or the stored settings would be
+	// hidden until the next restart.
+	loaded, err := loadUserSettings(context.Background(), channelID, userID)
+	if err != nil {
+		return userSettings{}, err
+	}
+
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	if settings[channelID] == nil {
+		settings[channelID] = make(map[string]*userSettings)
+	}
+	if existing := settings[channelID][userID]; existing != nil {
+		return *existing, nil
+	}
+	settings[channelID][userID] = loaded
+	return *loaded, nil
+}
+
+// updateUserSettings applies update to the user's settings, saves them and
+// refreshes the cache. It returns whatever update returns. If the settings
+// can't be loaded or saved, nothing changes and the error is returned.
+func updateUserSettings(channelID, userID string, update func(us *userSettings) string) (string, error) {
+	settingsUpdateMu.Lock()
+	defer settingsUpdateMu.Unlock()
+	us, err := lookupUserSettings(channelID, userID)
+	if err != nil {
+		return "", err
+	}
+	content := update(&us)
+	if err := saveUserSettings(context.Background(), channelID, userID, &us); err != nil {
+		return "", err
+	}
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	if settings[channelID] == nil {
+		settings[channelID] = make(map[string]*userSettings)
+	}
+	settings[channelID][userID] = &us
+	return content, nil
+}
+
+func loadUserSettings(ctx context.Context, channelID, userID string) (*userSettings, error) {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	us := defaultUserSettings()
+	var thinkingLevel string
+	err = database.Pool.QueryRow(ctx, `
+		SELECT model, thinking_level, search, code_execution, aspect_ratio, image_size, force_markdown_rendering, split_responses
+		FROM gemini_user_settings
+		WHERE channel_id = $1 AND user_id = $2
+	`, cID, uID).Scan(&us.model, &thinkingLevel, &us.search, &us.codeExecution, &us.aspectRatio, &us.imageSize, &us.forceMarkdownRendering, &us.splitResponses)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return us, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	us.thinkingLevel = genai.ThinkingLevel(thinkingLevel)
+
+	// The model may have been retired since the settings were saved.
+	if _, ok := getModel(us.model); !ok {
+		def := defaultUserSettings()
+		us.model, us.thinkingLevel = def.model, def.thinkingLevel
+	}
+	return us, nil
+}
+
+func saveUserSettings(ctx context.Context, channelID, userID string, us *userSettings) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `
+		INSERT INTO gemini_user_settings (channel_id, user_id, model, thinking_level, search, code_execution, aspect_ratio, image_size, force_markdown_rendering, split_responses)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (channel_id, user_id) DO UPDATE
+		SET model = EXCLUDED.model,
+			thinking_level = EXCLUDED.thinking_level,
+			search = EXCLUDED.search,
+			code_execution = EXCLUDED.code_execution,
+			aspect_ratio = EXCLUDED.aspect_ratio,
+			image_size = EXCLUDED.image_size,
+			force_markdown_rendering = EXCLUDED.force_markdown_rendering,
+			split_responses = EXCLUDED.split_responses
+	`, cID, uID, us.model, string(us.thinkingLevel), us.search, us.codeExecution, us.aspectRatio, us.imageSize, us.forceMarkdownRendering, us.splitResponses)
+	return err
+}
+
+// getChannelSettings returns a copy of the channel's settings, or the defaults
+// if they can't be loaded.
+func getChannelSettings(channelID string) channelSettings {
+	cs, err := lookupChannelSettings(channelID)
+	if err != nil {
+		log.Println("Error loading Gemini channel settings", err)
+		return channelSettings{}
+	}
+	return cs
+}
+
+// lookupChannelSettings returns a copy of the channel's settings, cached the
+// same way as lookupUserSettings.
+func lookupChannelSettings(channelID string) (channelSettings, error) {
+	geminiMu.Lock()
+	cs, ok := chanSettings[channelID]
+	geminiMu.Unlock()
+	if ok {
+		return *cs, nil
+	}
+
+	loaded, err := loadChannelSettings(context.Background(), channelID)
+	if err != nil {
+		return channelSettings{}, err
+	}
+
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	if existing := chanSettings[channelID]; existing != nil {
+		return *existing, nil
+	}
+	chanSettings[channelID] = loaded
+	return *loaded, nil
+}
+
+// updateChannelSettings applies update to the channel's settings like
+// updateUserSettings does to a user's.
+func updateChannelSettings(channelID string, update func(cs *channelSettings) string) (string, error) {
+	settingsUpdateMu.Lock()
+	defer settingsUpdateMu.Unlock()
+	cs, err := lookupChannelSettings(channelID)
+	if err != nil {
+		return "", err
+	}
+	content := update(&cs)
+	if err := saveChannelSettings(context.Background(), channelID, &cs); err != nil {
+		return "", err
+	}
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	chanSettings[channelID] = &cs
+	return content, nil
+}
+
+func loadChannelSettings(ctx context.Context, channelID string) (*channelSettings, error) {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var cs channelSettings
+	err = database.Pool.QueryRow(ctx, `
+		SELECT summarize, threads
+		FROM gemini_channel_settings
+		WHERE channel_id = $1
+	`, cID).Scan(&cs.summarize, &cs.threads)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+func saveChannelSettings(ctx context.Context, channelID string, cs *channelSettings) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `
+		INSERT INTO gemini_channel_settings (channel_id, summarize, threads)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (channel_id) DO UPDATE
+		SET summarize = EXCLUDED.summarize,
+			threads = EXCLUDED.threads
+	`, cID, cs.summarize, cs.threads)
+	return err
+}
+
+// deleteSettings removes every user and channel setting, and the persona,
+// stored for a channel.
+func deleteSettings(ctx context.Context, channelID string) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	// A statement with arguments can only hold one command.
+	for _, query := range []string{
+		`DELETE FROM gemini_user_settings WHERE channel_id = $1`,
+		`DELETE FROM gemini_channel_settings WHERE channel_id = $1`,
+		`DELETE FROM gemini_personas WHERE target_id = $1`,
+	} {
+		if _, err := database.Pool.Exec(ctx, query, cID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
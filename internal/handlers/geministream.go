@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/clients"
+)
+
+// Discord allows 5 message edits per 5 seconds in a channel.
+const streamEditInterval = 1500 * time.Millisecond
+
+// generateContentStreamWithRetry streams a response, passing the text so far to
+// onText at most once per streamEditInterval, and returns the streamed chunks
+// merged into one response. Failed attempts are only retried if nothing was
+// streamed yet.
+func generateContentStreamWithRetry(ctx context.Context, model string, contents []*genai.Content, config *genai.GenerateContentConfig, onText func(text string)) (*genai.GenerateContentResponse, error) {
+	for attempt := 0; ; attempt++ {
+		var merged streamMerger
+		var lastUpdate time.Time
+		var err error
+		for chunk, chunkErr := range clients.GeminiClient.Models.GenerateContentStream(ctx, model, contents, config) {
+			if chunkErr != nil {
+				err = chunkErr
+				break
+			}
+			merged.add(chunk)
+			if text := merged.text(); text != "" && time.Since(lastUpdate) >= streamEditInterval {
+				lastUpdate = time.Now()
+				onText(text)
+			}
+		}
+		if err == nil && merged.chunks == 0 {
+			return nil, errors.New("the response stream ended without any content")
+		}
+		if err == nil {
+			return merged.response(), nil
+		}
+		if merged.chunks > 0 {
+			return merged.response(), err
+		}
+		if !isRetryable(err) || attempt >= retryAttempts {
+			return nil, err
+		}
+
+		delay := retryDelay(attempt)
+		log.Printf("GenerateContentStream failed (%v), retrying in %v (attempt %d/%d)", err, delay, attempt+1, retryAttempts)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// streamMerger accumulates streamed chunks. Consecutive text parts are joined
+// so the merged content looks like a non-streamed response.
+type streamMerger struct {
+	chunks int
+	parts  []*genai.Part
+	last   *genai.GenerateContentResponse
+}
+
+func (sm *streamMerger) add(chunk *genai.GenerateContentResponse) {
+	sm.chunks++
+	sm.last = chunk
+	if len(chunk.Candidates) == 0 || chunk.Candidates[0].Content == nil {
+		return
+	}
+	for _, p := range chunk.Candidates[0].Content.Parts {
+		if p == nil {
+			continue
+		}
+		if n := len(sm.parts); n > 0 && isPlainText(p) && isPlainText(sm.parts[n-1]) &&
+			sm.parts[n-1].Thought == p.Thought && sm.parts[n-1].ThoughtSignature == nil {
+			prev := *sm.parts[n-1]
+			prev.Text += p.Text
+			prev.ThoughtSignature = p.ThoughtSignature
+			sm.parts[n-1] = &prev
+			continue
+		}
+		cp := *p
+		sm.parts = append(sm.parts, &cp)
+	}
+}
+
+func (sm *streamMerger) text() string {
+	var sb strings.Builder
+	for _, p := range sm.parts {
+		if !p.Thought {
+			sb.WriteString(p.Text)
+		}
+	}
+	return sb.String()
+}
+
+func (sm *streamMerger) response() *genai.GenerateContentResponse {
+	if sm.last == nil {
+		return nil
+	}
+	res := *sm.last
+	var candidate genai.Candidate
+	if len(res.Candidates) > 0 {
+		candidate = *res.Candidates[0]
+	}
+	candidate.Content = &genai.Content{Role: genai.RoleModel, Parts: sm.parts}
+	res.Candidates = []*genai.Candidate{&candidate}
+	return &res
+}
+
+// isPlainText reports whether p is a text part that can be joined with others.
+func isPlainText(p *genai.Part) bool {
+	return p.InlineData == nil &&
+		p.FileData == nil &&
+		p.FunctionCall == nil &&
+		p.FunctionResponse == nil &&
+		p.ExecutableCode == nil &&
+		p.CodeExecutionResult == nil &&
+		p.ToolCall == nil &&
+		p.ToolResponse == nil
+}
+
+func getStreamingText(us *userSettings, startTime time.Time, text string) string {
+	subtext := fmt.Sprintf("-# ✍️ %.1fs    🤖 %s    🧠 %s", time.Since(startTime).Seconds(), us.model, strings.ToLower(string(us.thinkingLevel)))
+	limit := maxMsgLength - len(subtext) - len("\n…")
+	if len(text) > limit {
+		text = strings.ToValidUTF8(text[:limit], "") + "…"
+	}
+	return subtext + "\n" + text
+}
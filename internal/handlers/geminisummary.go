@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const (
+	geminiSummarySchema = `
+		CREATE TABLE IF NOT EXISTS gemini_summaries (
+			channel_id bigint PRIMARY KEY,
+			summary    text   NOT NULL
+		);
+	`
+
+	maxSummaryChars = 4000
+
+	summaryInstruction = `You maintain a running summary of the earlier conversation in a Discord text channel.
+You are given the current summary (possibly empty) followed by chat log entries that are about to be forgotten.
+Rewrite the summary so that it also covers the new entries. Keep the people involved (by name and ID), the topics discussed, decisions, facts, and any open questions or requests.
+Drop small talk that is unlikely to matter later. Write plain prose or short bullet points, at most 3000 characters, and reply with the summary only.`
+)
+
+// evictedBatch is a batch of entries evicted from a channel's history at a
+// summary epoch.
+type evictedBatch struct {
+	entries []historyEntry
+	epoch   int
+}
+
+var (
+	// Batches waiting to be folded into each channel's summary, in the order
+	// they were evicted. A channel is present while runSummaries is working
+	// through its batches. Guarded by geminiMu.
+	pendingSummaries = map[string][]evictedBatch{}
+
+	// Counts the times each channel's summary was replaced by setSummary, so
+	// summarizeEvicted can tell whether it was cleared meanwhile. Guarded by
+	// geminiMu.
+	summaryEpochs = map[string]int{}
+)
+
+func init() {
+	ctx := context.Background()
+	if _, err := database.Pool.Exec(ctx, geminiSummarySchema); err != nil {
+		log.Println("Error creating Gemini summary table", err)
+	}
+	if err := loadSummaries(ctx); err != nil {
+		log.Println("Error loading Gemini summaries", err)
+	}
+}
+
+// summaryContent renders a summary as the first entry of the chat log, ended by
+// the delimiter like every message so nothing in it can pass for one.
+func summaryContent(summary string) *genai.Content {
+	return genai.NewContentFromParts([]*genai.Part{genai.NewPartFromText("summary: " + summary), delimiterPart()}, genai.RoleUser)
+}
+
+func loadSummaries(ctx context.Context) error {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT channel_id, summary
+		FROM gemini_summaries
+		WHERE channel_id NOT IN (SELECT thread_id FROM gemini_archived_threads)
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	for rows.Next() {
+		var channelID int64
+		var summary string
+		if err := rows.Scan(&channelID, &summary); err != nil {
+			return err
+		}
+		summaries[strconv.FormatInt(channelID, 10)] = summary
+	}
+	return rows.Err()
+}
+
+// loadSummary reloads one channel's summary, for a thread whose summary was
+// freed when it was archived.
+func loadSummary(ctx context.Context, channelID string) error {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	var summary string
+	err = database.Pool.QueryRow(ctx, `SELECT summary FROM gemini_summaries WHERE channel_id = $1`, cID).Scan(&summary)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	geminiMu.Lock()
+	summaries[channelID] = summary
+	geminiMu.Unlock()
+	return nil
+}
+
+// setSummary replaces the channel's summary. An empty summary deletes it. A
+// summary of evicted history that is still being written is dropped, so it
+// can't bring back what was just cleared.
+func setSummary(channelID, summary string) {
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	summaryEpochs[channelID]++
+	storeSummary(channelID, summary)
+}
+
+// storeSummary updates the summaries map and queues the matching database
+// write, in order with the history's writes. geminiMu must be held.
+func storeSummary(channelID, summary string) {
+	if summary == "" {
+		delete(summaries, channelID)
+	} else {
+		summaries[channelID] = summary
+	}
+	queueHistoryWrite(func(ctx context.Context) error {
+		cID, err := strconv.ParseInt(channelID, 10, 64)
+		if err != nil {
+			return err
+		}
+		if summary == "" {
+			_, err = database.Pool.Exec(ctx, `DELETE FROM gemini_summaries WHERE channel_id = $1`, cID)
+			return err
+		}
+		_, err = database.Pool.Exec(ctx, `
+			INSERT INTO gemini_summaries (channel_id, summary)
+			VALUES ($1, $2)
+			ON CONFLICT (channel_id) DO UPDATE
+			SET summary = EXCLUDED.summary
+		`, cID, summary)
+		return err
+	})
+}
+
+// summaryModel returns the model that writes summaries, and the thinking
+// level to use with it: the preferred model, or another text model if it
+// was retired.
+func summaryModel() (string, genai.ThinkingLevel) {
+	const preferred = "gemini-3.5-flash"
+	model := preferred
+	if info, ok := getModel(preferred); !ok || info.imageOutput {
+		for _, name := range listModels() {
+			if info, _ := getModel(name); !info.imageOutput {
+				model = name
+				break
+			}
+		}
+	}
+	if info, _ := getModel(model); len(info.thinkingLevels) > 0 {
+		return model, info.thinkingLevels[0]
+	}
+	return model, ""
+}
+
+// queueSummary queues entries evicted from the channel's history at epoch to be
+// folded into its summary after those evicted before them. geminiMu must be
+// held.
+func queueSummary(channelID string, evicted []historyEntry, epoch int) {
+	_, running := pendingSummaries[channelID]
+	pendingSummaries[channelID] = append(pendingSummaries[channelID], evictedBatch{evicted, epoch})
+	if !running {
+		go runSummaries(channelID)
+	}
+}
+
+// runSummaries summarizes a channel's queued batches one at a time until none
+// are left.
+func runSummaries(channelID string) {
+	for {
+		geminiMu.Lock()
+		batches := pendingSummaries[channelID]
+		if len(batches) == 0 {
+			delete(pendingSummaries, channelID)
+			geminiMu.Unlock()
+			return
+		}
+		pendingSummaries[channelID] = nil
+		geminiMu.Unlock()
+		for _, b := range batches {
+			summarizeEvicted(channelID, b.entries, b.epoch)
+		}
+	}
+}
+
+// summarizeEvicted folds entries that were evicted from the channel's history
+// into its running summary, unless the summary was replaced since the entries
+// were evicted at epoch.
+func summarizeEvicted(channelID string, evicted []historyEntry, epoch int) {
+	transcript := transcribeEntries(evicted)
+	if transcript == "" {
+		return
+	}
+	geminiMu.Lock()
+	current := summaries[channelID]
+	cleared := summaryEpochs[channelID] != epoch
+	geminiMu.Unlock()
+	if cleared {
+		return
+	}
+
+	prompt := fmt.Sprintf("Current summary:\n%s\n\nEntries to add:\n%s", current, transcript)
+	model, thinkingLevel := summaryModel()
+	config := &genai.GenerateContentConfig{
+		SafetySettings:    safetySettings,
+		SystemInstruction: genai.NewContentFromText(summaryInstruction, genai.RoleUser),
+	}
+	if thinkingLevel != "" {
+		config.ThinkingConfig = &genai.ThinkingConfig{ThinkingLevel: thinkingLevel}
+	}
+	res, err := generateContentWithRetry(context.Background(), model, []*genai.Content{genai.NewContentFromText(prompt, genai.RoleUser)}, config)
+	if err != nil {
+		log.Println("Error summarizing Gemini history", err)
+		return
+	}
+	summary := strings.TrimSpace(res.Text())
+	if summary == "" {
+		return
+	}
+	if len(summary) > maxSummaryChars {
+		summary = strings.ToValidUTF8(summary[:maxSummaryChars], "")
+	}
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	if summaryEpochs[channelID] != epoch {
+		return // cleared while the summary was written
+	}
+	storeSummary(channelID, summary)
+}
+
+// transcribeEntries renders history entries as plain text for the summarizer.
+func transcribeEntries(entries []historyEntry) string {
+	var sb strings.Builder
+	for _, e := range entries {
+		for _, p := range e.content.Parts {
+			switch {
+			case p.Thought:
+			case p.FunctionCall != nil:
+				fmt.Fprintf(&sb, "[the bot called the %s tool]\n", p.FunctionCall.Name)
+			case p.FunctionResponse != nil:
+			case p.InlineData != nil:
+				fmt.Fprintf(&sb, "[%s attachment]\n", p.InlineData.MIMEType)
+			case p.FileData != nil:
+				fmt.Fprintf(&sb, "[%s attachment]\n", p.FileData.MIMEType)
+			case delimiterPartRegexp.MatchString(p.Text):
+				sb.WriteString("\n")
+			case p.Text != "":
+				if e.content.Role == genai.RoleModel {
+					sb.WriteString("the bot: ")
+				}
+				sb.WriteString(p.Text)
+				sb.WriteString("\n")
+			}
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+)
+
+const (
+	threadArchiveMinutes = 1440
+	maxThreadNameLength  = 100
+)
+
+// Bot threads whose history, summary and settings were freed when they were
+// archived, guarded by geminiMu. It is stored in gemini_archived_threads so
+// archived threads stay unloaded across restarts.
+var archivedThreads = map[string]bool{}
+
+// isGeminiThread reports whether channelID is a conversation thread the bot
+// started in a channel that still has thread mode enabled.
+func isGeminiThread(s *discordgo.Session, channelID string) bool {
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		return false
+	}
+	return ch.IsThread() && ch.OwnerID == s.State.User.ID && getChannelSettings(ch.ParentID).threads
+}
+
+// startGeminiThread starts a thread on the message that mentioned the bot and
+// seeds it with that message and the requester's settings from the parent
+// channel. From then on the thread has its own history and settings.
+func startGeminiThread(s *discordgo.Session, m *discordgo.MessageCreate, parts []*genai.Part) (string, bool) {
+	thread, err := s.MessageThreadStartComplex(m.ChannelID, m.ID, &discordgo.ThreadStart{
+		Name:                threadName(s, m.Message),
+		AutoArchiveDuration: threadArchiveMinutes,
+	})
+	if err != nil {
+		log.Println("Error starting Gemini thread", err)
+		return "", false
+	}
+
+	parent := getUserSettings(m.ChannelID, m.Author.ID)
+	_, err = updateUserSettings(thread.ID, m.Author.ID, func(us *userSettings) string {
+		*us = parent
+		return ""
+	})
+	if err != nil {
+		log.Println("Error copying Gemini settings to thread", err)
+	}
+	appendHistory(thread.ID, m.ID, genai.NewContentFromParts(parts, genai.RoleUser))
+	return thread.ID, true
+}
+
+func threadName(s *discordgo.Session, m *discordgo.Message) string {
+	name := strings.ReplaceAll(m.ContentWithMentionsReplaced(), "@"+s.State.User.Username, "")
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		name = "Conversation with " + displayName(m)
+	}
+	if runes := []rune(name); len(runes) > maxThreadNameLength {
+		name = string(runes[:maxThreadNameLength-1]) + "…"
+	}
+	return name
+}
+
+func geminiThreadUpdateHandler(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	if t.OwnerID != s.State.User.ID || t.ThreadMetadata == nil {
+		return
+	}
+	if t.ThreadMetadata.Archived {
+		freeThread(t.ID)
+	} else {
+		restoreThread(t.ID)
+	}
+}
+
+func geminiThreadDeleteHandler(s *discordgo.Session, t *discordgo.ThreadDelete) {
+	// The state no longer has the thread, so its owner is unknown. Deleting
+	// the rows of a thread the bot never used is a no-op.
+	freeThread(t.ID)
+	geminiMu.Lock()
+	delete(archivedThreads, t.ID)
+	queueSetThreadArchived(t.ID, false)
+	queueClearHistory(t.ID)
+	geminiMu.Unlock()
+	setSummary(t.ID, "")
+
+	if err := deleteSettings(context.Background(), t.ID); err != nil {
+		log.Println("Error deleting Gemini thread settings", err)
+	}
+}
+
+// freeThread drops a thread's history, summary, settings and persona from memory. They
+// stay in the database until the thread is deleted.
+func freeThread(threadID string) {
+	geminiMu.Lock()
+	defer geminiMu.Unlock()
+	delete(history, threadID)
+	delete(summaries, threadID)
+	delete(settings, threadID)
+	delete(chanSettings, threadID)
+	delete(personas, threadID)
+	archivedThreads[threadID] = true
+	queueSetThreadArchived(threadID, true)
+}
+
+// restoreThread reloads a thread that was freed by freeThread. Sending a
+// message unarchives a thread, so this is also called for every message in
+// case it arrives before the thread update.
+func restoreThread(threadID string) {
+	geminiMu.Lock()
+	archived := archivedThreads[threadID]
+	if archived {
+		delete(archivedThreads, threadID)
+		queueSetThreadArchived(threadID, false)
+	}
+	geminiMu.Unlock()
+	if !archived {
+		return
+	}
+
+	ctx := context.Background()
+	if err := loadChannelHistory(ctx, threadID); err != nil {
+		log.Println("Error reloading Gemini thread history", err)
+	}
+	if err := loadSummary(ctx, threadID); err != nil {
+		log.Println("Error reloading Gemini thread summary", err)
+	}
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/clients"
+)
+
+// tool is a function the model can call. Handlers register tools in init()
+// with registerTool.
+type tool struct {
+	declaration *genai.FunctionDeclaration
+	handler     func(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error)
+	available   func(scope toolScope) bool // nil means the tool is always available
+}
+
+const (
+	maxParallelToolCalls = 4
+	toolCallTimeout      = 30 * time.Second
+
+	defaultMaxToolRounds  = 5
+	defaultToolTimeBudget = 2 * time.Minute
+
+	defaultSemanticResults = 10
+	maxSemanticResults     = 50
+)
+
+// toolScope is who a tool would run for and where.
+type toolScope struct {
+	s           *discordgo.Session
+	model       string
+	channelID   string
+	requesterID string
+}
+
+// toolResult is what a tool returns to the model, plus what the audit log
+// records about it.
+type toolResult struct {
+	output  any
+	note    string // sent alongside the output, e.g. to say it was truncated
+	rows    int
+	sources []toolSource
+	users   map[string]userInfo // people mentioned in the output
+	guildID string              // server the output's user IDs belong to, if not the current one
+}
+
+var (
+	firstMsgsFuncDeclaration = &genai.FunctionDeclaration{
+		Name: "first_msgs",
+		Description: `Gets information about winning "first messages" by making a SELECT SQL query to the database.
+The data is stored in a single table called first_messages.
+Every row represents the winning "first message" sent on a specific calendar day.
+There is strictly one row per day.
+Available columns:
+1. iso_date (date): The exact calendar date the message was sent, formatted as YYYY-MM-DD (e.g., '2018-01-28'). This is the primary key.
+2. content (text): The actual text content of the message.
+3. timestamp_ms (bigint): The exact time the message was sent, recorded as a Unix millisecond number.
+4. message_id (bigint): Discord's ID for the specific message.
+5. timezone (varchar): The timezone used to determine when the day started (e.g., 'America/Los_Angeles').
+6. user_id (bigint): Discord's ID for the user who sent the message.
+7. speed (bigint): The reaction time, recorded in milliseconds, representing how quickly the user sent the message after the new day officially began.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"query": {
+					Type:        genai.TypeString,
+					Description: "SELECT SQL query to make to the database",
+				},
+			},
+			Required: []string{"query"},
+		},
+	}
+
+	searchMessagesSQLFuncDeclaration = &genai.FunctionDeclaration{
+		Name: "search_messages_sql",
+		Description: `Searches the channel message history by making a SELECT SQL query to the database.
+The data is stored in a single table called messages, where each row is one message that was sent in the channel.
+The full history of the channel is stored, going back to 2018, and there are MILLIONS of rows.
+Because the table is so large, you MUST always narrow your queries: filter with a WHERE clause and/or include a LIMIT (e.g. LIMIT 50) so you don't pull back huge result sets. 
+Available columns:
+1. message_id (bigint): Discord's ID for the specific message. This is the primary key.
+2. user_id (bigint): Discord's ID for the user who sent the message.
+3. timestamp_ms (bigint): The exact time the message was sent, recorded as a Unix millisecond number.
+4. content (text): The actual text content of the message. May be empty (e.g. for messages that only had attachments). To search for a word or phrase, filter with "content ILIKE '%word%'"; a trigram index backs this column, so case-insensitive substring matches stay fast even across millions of rows.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"query": {
+					Type:        genai.TypeString,
+					Description: "SELECT SQL query to make to the database",
+				},
+			},
+			Required: []string{"query"},
+		},
+	}
+
+	searchMessagesSemanticFuncDeclaration = &genai.FunctionDeclaration{
+		Name: "search_messages_semantic",
+		Description: `Searches the channel message history by meaning using vector embeddings.
+Use this when the user describes a conversation, topic, or idea in their own words and you want messages that are semantically related even if they don't share the same keywords (e.g. "that argument about whether tabs or spaces are better", "when people discussed moving to a new game"). 
+For exact keyword or structured lookups, prefer the "search_messages_sql" tool instead.
+Messages are grouped into conversation chunks (consecutive messages within a 30-minute window). Each result is one chunk and includes its formatted text, the time range, and the participant user IDs.
+Each line within a chunk's text is formatted as "[YYYY-MM-DD HH:MM] <@user_id>: content" with timestamps in UTC.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"query": {
+					Type:        genai.TypeString,
+					Description: "Natural-language description of what to search for",
+				},
+				"limit": {
+					Type:        genai.TypeInteger,
+					Description: "If set, the maximum number of chunks to return, at most 50; defaults to 10",
+				},
+				"user_id": {
+					Type:        genai.TypeString,
+					Description: "If set, only return chunks that this Discord user ID participated in",
+				},
+				"start_ms": {
+					Type:        genai.TypeInteger,
+					Description: "If set, only return chunks whose conversation ended at or after this Unix millisecond time",
+				},
+				"end_ms": {
+					Type:        genai.TypeInteger,
+					Description: "If set, only return chunks whose conversation started at or before this Unix millisecond time",
+				},
+			},
+			Required: []string{"query"},
+		},
+	}
+)
+
+func init() {
+	if err := checkSandboxRole(context.Background()); err != nil {
+		log.Println("Gemini SQL tools are disabled:", err)
+	} else {
+		registerTool(tool{declaration: firstMsgsFuncDeclaration, handler: sqlToolHandler("first_messages")})
+		registerTool(tool{declaration: searchMessagesSQLFuncDeclaration, handler: sqlToolHandler("messages")})
+	}
+	registerTool(tool{declaration: searchMessagesSemanticFuncDeclaration, handler: searchMessagesSemanticHandler})
+}
+
+// availableTools returns the declarations of the tools available in scope,
+// sorted by name so the request is the same every time.
+func availableTools(scope toolScope) []*genai.FunctionDeclaration {
+	var decls []*genai.FunctionDeclaration
+	for _, name := range slices.Sorted(maps.Keys(tools)) {
+		t := tools[name]
+		if t.available == nil || t.available(scope) {
+			decls = append(decls, t.declaration)
+		}
+	}
+	return decls
+}
+
+// callTool runs the tool the model called. Unknown and unavailable tools get
+// an error the model can recover from instead of an empty response.
+func callTool(ctx context.Context, scope toolScope, fc *genai.FunctionCall) (toolResult, error) {
+	t, ok := tools[fc.Name]
+	if !ok {
+		names := make([]string, 0, len(tools))
+		for _, decl := range availableTools(scope) {
+			names = append(names, decl.Name)
+		}
+		return toolResult{}, fmt.Errorf("unknown function %q; the available functions are: %s", fc.Name, strings.Join(names, ", "))
+	}
+	if t.available != nil && !t.available(scope) {
+		return toolResult{}, fmt.Errorf("function %q is not available here", fc.Name)
+	}
+	return t.handler(ctx, scope, fc.Args)
+}
+
+// runToolCalls runs the function calls of one model turn, at most
+// maxParallelToolCalls at a time, and returns all of their responses in one
+// content in call order.
+func runToolCalls(ctx context.Context, t *turn, fcs []*genai.FunctionCall) *genai.Content {
+	calls := make([]toolCall, len(fcs))
+	parts := make([]*genai.Part, len(fcs))
+	sem := make(chan struct{}, maxParallelToolCalls)
+	var wg sync.WaitGroup
+	for i, fc := range fcs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			callCtx, cancel := context.WithTimeout(ctx, toolCallTimeout)
+			defer cancel()
+			call := toolCall{name: fc.Name, args: fc.Args, startedAt: time.Now()}
+			result, err := callTool(callCtx, t.scope, fc)
+			if err == nil && fc.Name != lookupUsersToolKey {
+				result.users = enrichUsers(callCtx, t.scope, result)
+			}
+			if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("%s timed out after %v", fc.Name, toolCallTimeout)
+			}
+			call.duration = time.Since(call.startedAt)
+			call.rows, call.err, call.sources = result.rows, err, result.sources
+			calls[i] = call
+
+			parts[i] = genai.NewPartFromFunctionResponse(fc.Name, result.functionResponse(err))
+			parts[i].FunctionResponse.ID = fc.ID
+		}()
+	}
+	wg.Wait()
+
+	for _, call := range calls {
+		t.logToolCall(call)
+	}
+	return genai.NewContentFromParts(parts, genai.RoleUser)
+}
+
+// toolLimits returns how many rounds of function calls one response may make
+// and how long they may take in total. GEMINI_MAX_TOOL_ROUNDS and
+// GEMINI_TOOL_TIME_BUDGET (a Go duration such as "90s") override the defaults.
+func toolLimits() (int, time.Duration) {
+	maxRounds, budget := defaultMaxToolRounds, defaultToolTimeBudget
+	if v := os.Getenv("GEMINI_MAX_TOOL_ROUNDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxRounds = n
+		} else {
+			log.Println("Invalid GEMINI_MAX_TOOL_ROUNDS", v)
+		}
+	}
+	if v := os.Getenv("GEMINI_TOOL_TIME_BUDGET"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			budget = d
+		} else {
+			log.Println("Invalid GEMINI_TOOL_TIME_BUDGET", v)
+		}
+	}
+	return maxRounds, budget
+}
+
+// skipToolCalls answers function calls with an error instead of running them,
+// so every call in history still has a response.
+func skipToolCalls(fcs []*genai.FunctionCall, reason string) *genai.Content {
+	parts := make([]*genai.Part, len(fcs))
+	for i, fc := range fcs {
+		parts[i] = genai.NewPartFromFunctionResponse(fc.Name, map[string]any{"error": reason})
+		parts[i].FunctionResponse.ID = fc.ID
+	}
+	return genai.NewContentFromParts(parts, genai.RoleUser)
+}
+
+// functionResponse turns a tool's result into the response sent to the model.
+func (r toolResult) functionResponse(err error) map[string]any {
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	resp := map[string]any{"output": r.output}
+	if r.note != "" {
+		resp["note"] = r.note
+	}
+	if len(r.users) > 0 {
+		resp["users"] = r.users
+	}
+	return resp
+}
+
+// sqlToolHandler returns a handler that runs the model's query in the SQL
+// sandbox, limited to tables.
+func sqlToolHandler(tables ...string) func(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+	return func(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+		query, _ := args["query"].(string)
+		result, note, err := sandboxedQuery(ctx, query, tables)
+		if err != nil {
+			return toolResult{}, err
+		}
+		// The tables hold the archived server's messages.
+		return toolResult{output: result, note: note, rows: len(result), sources: messageSources(result), guildID: guildID}, nil
+	}
+}
+
+func searchMessagesSemanticHandler(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+	result, err := searchMessagesSemantic(ctx, args)
+	if err != nil {
+		return toolResult{}, err
+	}
+	return toolResult{output: result, rows: len(result), sources: chunkSources(result), guildID: guildID}, nil
+}
+
+func searchMessagesSemantic(ctx context.Context, args map[string]any) ([]map[string]any, error) {
+	query, _ := args["query"].(string)
+	if query == "" {
+		return nil, errors.New("query is required")
+	}
+
+	dim := int32(embedDims)
+	res, err := clients.GeminiClient.Models.EmbedContent(ctx, embedModel,
+		[]*genai.Content{genai.NewContentFromText(query, genai.RoleUser)},
+		&genai.EmbedContentConfig{TaskType: "RETRIEVAL_QUERY", OutputDimensionality: &dim})
+	if err != nil {
+		return nil, err
+	}
+	queryVec := vectorString(normalize(res.Embeddings[0].Values))
+
+	limit := defaultSemanticResults
+	if v, ok := args["limit"].(float64); ok && v > 0 {
+		limit = int(min(v, maxSemanticResults))
+	}
+
+	sql := `SELECT start_ms, end_ms, user_ids, content FROM message_chunks`
+	conds := []string{}
+	params := []any{}
+	if userID, ok := args["user_id"].(string); ok && userID != "" {
+		id, err := strconv.ParseInt(userID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user_id: %w", err)
+		}
+		params = append(params, id)
+		conds = append(conds, fmt.Sprintf("user_ids @> ARRAY[$%d]::bigint[]", len(params)))
+	}
+	if v, ok := args["start_ms"].(float64); ok {
+		params = append(params, int64(v))
+		conds = append(conds, fmt.Sprintf("end_ms >= $%d", len(params)))
+	}
+	if v, ok := args["end_ms"].(float64); ok {
+		params = append(params, int64(v))
+		conds = append(conds, fmt.Sprintf("start_ms <= $%d", len(params)))
+	}
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	params = append(params, queryVec)
+	sql += fmt.Sprintf(" ORDER BY embedding <#> $%d::halfvec LIMIT %d", len(params), limit)
+
+	return queryDb(ctx, sql, params...)
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+const (
+	// Fraction of a model's input token limit that history may fill, leaving
+	// room for the system instruction, tool declarations and the response.
+	defaultHistoryTokenFraction = 0.75
+	// Caps the history sent with each request however large the model's
+	// context is, since every token of it is paid for on every mention.
+	defaultMaxHistoryTokens = 128_000
+
+	entryTokenOverhead = 4
+	imageTokens        = 1120
+	pdfBytesPerToken   = 100
+	audioBytesPerToken = 500
+	videoBytesPerToken = 4000
+	charsPerToken      = 4
+)
+
+var (
+	historyTokenFraction = defaultHistoryTokenFraction
+	maxHistoryTokens     = defaultMaxHistoryTokens
+)
+
+func init() {
+	if v := os.Getenv("GEMINI_HISTORY_TOKEN_FRACTION"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 && f <= 1 {
+			historyTokenFraction = f
+		} else {
+			log.Println("Invalid GEMINI_HISTORY_TOKEN_FRACTION", v)
+		}
+	}
+	if v := os.Getenv("GEMINI_HISTORY_MAX_TOKENS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxHistoryTokens = n
+		} else {
+			log.Println("Invalid GEMINI_HISTORY_MAX_TOKENS", v)
+		}
+	}
+}
+
+type trimResult struct {
+	kept     []historyEntry
+	evicted  []historyEntry
+	stripped []historyEntry // kept entries whose media parts were removed
+}
+
+// historyTokenBudget returns how many history tokens may be sent to model: a
+// fraction of its input token limit, up to maxHistoryTokens.
+func historyTokenBudget(model string) int {
+	return min(int(float64(modelInputTokenLimit(model))*historyTokenFraction), maxHistoryTokens)
+}
+
+// maxHistoryTokenBudget is the largest budget of any built-in or configured
+// model, which bounds how much history is kept around at all. Discovered
+// models only count if there are no others, so one with a large limit can't
+// make every channel keep more history.
+func maxHistoryTokenBudget() int {
+	budget, discoveredBudget := 0, 0
+	for _, model := range listModels() {
+		if info, _ := getModel(model); info.discovered {
+			discoveredBudget = max(discoveredBudget, historyTokenBudget(model))
+		} else {
+			budget = max(budget, historyTokenBudget(model))
+		}
+	}
+	if budget == 0 {
+		return discoveredBudget
+	}
+	return budget
+}
+
+// estimateTokens roughly estimates how many tokens a content will use. It is
+// cached on each history entry so trimming never has to call CountTokens.
+func estimateTokens(c *genai.Content) int {
+	tokens := entryTokenOverhead
+	for _, p := range c.Parts {
+		tokens += estimatePartTokens(p)
+	}
+	return tokens
+}
+
+func estimatePartTokens(p *genai.Part) int {
+	switch {
+	case p.InlineData != nil:
+		return estimateMediaTokens(p.InlineData.MIMEType, len(p.InlineData.Data))
+	case p.FileData != nil:
+		return estimateMediaTokens(p.FileData.MIMEType, 0)
+	case p.FunctionCall != nil:
+		data, _ := json.Marshal(p.FunctionCall)
+		return len(data) / charsPerToken
+	case p.FunctionResponse != nil:
+		data, _ := json.Marshal(p.FunctionResponse)
+		return len(data) / charsPerToken
+	case p.ExecutableCode != nil:
+		return len(p.ExecutableCode.Code) / charsPerToken
+	case p.CodeExecutionResult != nil:
+		return len(p.CodeExecutionResult.Output) / charsPerToken
+	}
+	return (len(p.Text) + charsPerToken - 1) / charsPerToken
+}
+
+func estimateMediaTokens(mimeType string, size int) int {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return imageTokens
+	case mimeType == "application/pdf":
+		return max(size/pdfBytesPerToken, imageTokens)
+	case strings.HasPrefix(mimeType, "audio/"):
+		return max(size/audioBytesPerToken, imageTokens)
+	case strings.HasPrefix(mimeType, "video/"):
+		return max(size/videoBytesPerToken, imageTokens)
+	}
+	return max(size/charsPerToken, imageTokens)
+}
+
+func hasMedia(c *genai.Content) bool {
+	for _, p := range c.Parts {
+		if p.InlineData != nil || p.FileData != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFunctionCall(c *genai.Content) bool {
+	for _, p := range c.Parts {
+		if p.FunctionCall != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFunctionResponse(c *genai.Content) bool {
+	for _, p := range c.Parts {
+		if p.FunctionResponse != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// stripMedia returns a copy of c with its media parts replaced by short notes.
+func stripMedia(c *genai.Content) *genai.Content {
+	stripped := &genai.Content{Role: c.Role, Parts: make([]*genai.Part, 0, len(c.Parts))}
+	for _, p := range c.Parts {
+		switch {
+		case p.InlineData != nil:
+			stripped.Parts = append(stripped.Parts, genai.NewPartFromText(fmt.Sprintf("[%s attachment removed from history]", p.InlineData.MIMEType)))
+		case p.FileData != nil:
+			stripped.Parts = append(stripped.Parts, genai.NewPartFromText(fmt.Sprintf("[%s attachment removed from history]", p.FileData.MIMEType)))
+		default:
+			stripped.Parts = append(stripped.Parts, p)
+		}
+	}
+	return stripped
+}
+
+// historyUnits groups entries so a function call is never separated from the
+// function responses that follow it. Each unit is the index of its first entry.
+func historyUnits(entries []historyEntry) []int {
+	var units []int
+	for i := 0; i < len(entries); i++ {
+		units = append(units, i)
+		if hasFunctionCall(entries[i].content) {
+			for i+1 < len(entries) && hasFunctionResponse(entries[i+1].content) {
+				i++
+			}
+		}
+	}
+	return units
+}
+
+// trimHistory fits entries into budget tokens. Media parts are removed from the
+// oldest entries first, and only if that isn't enough are whole units evicted
+// from the front. The newest unit is always kept intact.
+func trimHistory(entries []historyEntry, budget int) trimResult {
+	total := 0
+	for _, e := range entries {
+		total += e.tokens
+	}
+	units := historyUnits(entries)
+	if len(units) == 0 {
+		return trimResult{kept: entries}
+	}
+	last := units[len(units)-1]
+
+	kept := entries
+	var stripped []historyEntry
+	if total > budget {
+		kept = make([]historyEntry, len(entries))
+		copy(kept, entries)
+		for i := 0; i < last && total > budget; i++ {
+			if !hasMedia(kept[i].content) {
+				continue
+			}
+			e := kept[i]
+			e.content = stripMedia(e.content)
+			e.tokens = estimateTokens(e.content)
+			total -= kept[i].tokens - e.tokens
+			kept[i] = e
+			stripped = append(stripped, e)
+		}
+	}
+
+	start := 0
+	for u := 0; u < len(units)-1; u++ {
+		// A leading function response has lost its call, so it must go too.
+		orphan := hasFunctionResponse(kept[units[u]].content) && !hasFunctionCall(kept[units[u]].content)
+		if total <= budget && !orphan {
+			break
+		}
+		for i := units[u]; i < units[u+1]; i++ {
+			total -= kept[i].tokens
+		}
+		start = units[u+1]
+	}
+
+	res := trimResult{kept: kept[start:], evicted: entries[:start]}
+	for _, e := range stripped {
+		if !containsEntry(res.kept, e.seq) {
+			continue
+		}
+		res.stripped = append(res.stripped, e)
+	}
+	return res
+}
+
+func containsEntry(entries []historyEntry, seq int64) bool {
+	for _, e := range entries {
+		if e.seq == seq {
+			return true
+		}
+	}
+	return false
+}
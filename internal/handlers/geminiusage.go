@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const (
+	geminiUsageSchema = `
+		CREATE TABLE IF NOT EXISTS gemini_usage (
+			id                 bigserial   PRIMARY KEY,
+			created_at         timestamptz NOT NULL DEFAULT now(),
+			guild_id           bigint,
+			channel_id         bigint      NOT NULL,
+			user_id            bigint      NOT NULL,
+			model              text        NOT NULL,
+			prompt_tokens      bigint      NOT NULL,
+			candidates_tokens  bigint      NOT NULL,
+			thoughts_tokens    bigint      NOT NULL,
+			tool_prompt_tokens bigint      NOT NULL,
+			images             integer     NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS gemini_usage_user_idx ON gemini_usage (user_id, model, created_at);
+		CREATE INDEX IF NOT EXISTS gemini_usage_guild_idx ON gemini_usage (guild_id, created_at);
+		CREATE INDEX IF NOT EXISTS gemini_usage_channel_idx ON gemini_usage (channel_id, created_at);
+		CREATE TABLE IF NOT EXISTS gemini_quotas (
+			user_id        bigint  NOT NULL, -- 0 applies to everyone without their own row
+			model          text    NOT NULL,
+			daily_requests integer NOT NULL, -- 0 means unlimited
+			PRIMARY KEY (user_id, model)
+		);
+		CREATE TABLE IF NOT EXISTS gemini_channel_quotas (
+			channel_id     bigint  NOT NULL,
+			model          text    NOT NULL,
+			daily_requests integer NOT NULL, -- for everyone in the channel, 0 means unlimited
+			PRIMARY KEY (channel_id, model)
+		);
+		CREATE TABLE IF NOT EXISTS gemini_guild_quotas (
+			guild_id       bigint  NOT NULL,
+			model          text    NOT NULL,
+			daily_requests integer NOT NULL, -- for the whole server, 0 means unlimited
+			PRIMARY KEY (guild_id, model)
+		);
+	`
+
+	usageHistoryDays = 30
+)
+
+// usageTotals adds up the usage of every request made for one response.
+type usageTotals struct {
+	prompt     int64
+	candidates int64
+	thoughts   int64
+	toolPrompt int64
+	images     int
+}
+
+func init() {
+	if _, err := database.Pool.Exec(context.Background(), geminiUsageSchema); err != nil {
+		log.Println("Error creating Gemini usage tables", err)
+	}
+}
+
+func (u *usageTotals) add(res *genai.GenerateContentResponse) {
+	if res == nil {
+		return
+	}
+	if md := res.UsageMetadata; md != nil {
+		u.prompt += int64(md.PromptTokenCount)
+		u.candidates += int64(md.CandidatesTokenCount)
+		u.thoughts += int64(md.ThoughtsTokenCount)
+		u.toolPrompt += int64(md.ToolUsePromptTokenCount)
+	}
+	if len(res.Candidates) > 0 && res.Candidates[0].Content != nil {
+		for _, p := range res.Candidates[0].Content.Parts {
+			if p.InlineData != nil && strings.HasPrefix(p.InlineData.MIMEType, "image/") && !p.Thought {
+				u.images++
+			}
+		}
+	}
+}
+
+// estimateCost estimates what tokens cost in USD at model's list price.
+func estimateCost(model string, prompt, output int64) float64 {
+	info, ok := getModel(model)
+	if !ok {
+		return 0
+	}
+	return (float64(prompt)*info.inputPrice + float64(output)*info.outputPrice) / 1e6
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.In(timeZone)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, timeZone)
+}
+
+// channelGuildID returns the ID of the server a channel is in, or nil for a
+// DM or a channel that can't be fetched.
+func channelGuildID(s *discordgo.Session, channelID string) (*int64, error) {
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		if ch, err = s.Channel(channelID); err != nil {
+			log.Println("Error fetching channel", err)
+			return nil, nil
+		}
+	}
+	if ch.GuildID == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(ch.GuildID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// recordUsage fills in the usage of a request reserved by reserveQuota, or
+// records a new one if reservation is 0.
+func recordUsage(ctx context.Context, s *discordgo.Session, channelID, userID, model string, reservation int64, u *usageTotals) error {
+	if reservation != 0 {
+		_, err := database.Pool.Exec(ctx, `
+			UPDATE gemini_usage
+			SET model = $2, prompt_tokens = $3, candidates_tokens = $4, thoughts_tokens = $5, tool_prompt_tokens = $6, images = $7
+			WHERE id = $1
+		`, reservation, model, u.prompt, u.candidates, u.thoughts, u.toolPrompt, u.images)
+		return err
+	}
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return err
+	}
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return err
+	}
+	gID, err := channelGuildID(s, channelID)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `
+		INSERT INTO gemini_usage (guild_id, channel_id, user_id, model, prompt_tokens, candidates_tokens, thoughts_tokens, tool_prompt_tokens, images)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, gID, cID, uID, model, u.prompt, u.candidates, u.thoughts, u.toolPrompt, u.images)
+	return err
+}
+
+// dailyQuota returns how many requests userID may make to model per day. A
+// quota stored for the user wins over one stored for everyone, which wins over
+// the model's default. Zero means unlimited.
+func dailyQuota(ctx context.Context, userID int64, model string) (int, error) {
+	var quota int
+	err := database.Pool.QueryRow(ctx, `
+		SELECT daily_requests
+		FROM gemini_quotas
+		WHERE model = $1 AND user_id IN ($2, 0)
+		ORDER BY user_id DESC
+		LIMIT 1
+	`, model, userID).Scan(&quota)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if info, ok := getModel(model); ok {
+			return info.dailyRequests, nil
+		}
+		return 0, nil
+	}
+	return quota, err
+}
+
+// sharedDailyQuota returns how many requests everyone in a channel or server
+// together may make to model per day, from gemini_channel_quotas or
+// gemini_guild_quotas. Zero means unlimited.
+func sharedDailyQuota(ctx context.Context, table, column string, id int64, model string) (int, error) {
+	var quota int
+	err := database.Pool.QueryRow(ctx, fmt.Sprintf(`
+		SELECT daily_requests FROM %s WHERE %s = $1 AND model = $2
+	`, table, column), id, model).Scan(&quota)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return quota, err
+}
+
+// reserveQuota records n requests by userID to model for recordUsage to fill
+// in, and returns their IDs, or a refusal if that would go over the user's,
+// the channel's or the server's quota for today. Quotas are checked and the requests recorded
+// under a lock per model, so requests made at the same time can't overrun a
+// quota together. Errors fail open so an outage of the database doesn't take
+// the bot down with it.
+func reserveQuota(s *discordgo.Session, channelID, userID, model string, n int) ([]int64, string) {
+	ctx := context.Background()
+	ids, refusal, err := reserveRequests(ctx, s, channelID, userID, model, n)
+	if err != nil {
+		log.Println("Error reserving Gemini quota", err)
+		return nil, ""
+	}
+	return ids, refusal
+}
+
+func reserveRequests(ctx context.Context, s *discordgo.Session, channelID, userID, model string, n int) ([]int64, string, error) {
+	cID, err := strconv.ParseInt(channelID, 10, 64)
+	if err != nil {
+		return nil, "", err
+	}
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return nil, "", err
+	}
+	gID, err := channelGuildID(s, channelID)
+	if err != nil {
+		return nil, "", err
+	}
+	userQuota, err := dailyQuota(ctx, uID, model)
+	if err != nil {
+		return nil, "", err
+	}
+	channelQuota, err := sharedDailyQuota(ctx, "gemini_channel_quotas", "channel_id", cID, model)
+	if err != nil {
+		return nil, "", err
+	}
+	var guildQuota int
+	if gID != nil {
+		if guildQuota, err = sharedDailyQuota(ctx, "gemini_guild_quotas", "guild_id", *gID, model); err != nil {
+			return nil, "", err
+		}
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback(ctx)
+	if userQuota > 0 || channelQuota > 0 || guildQuota > 0 {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "gemini_quota:"+model); err != nil {
+			return nil, "", err
+		}
+		today := startOfDay(time.Now())
+		resets := today.AddDate(0, 0, 1).Unix()
+		var userUsed, channelUsed, guildUsed int
+		err := tx.QueryRow(ctx, `
+			SELECT count(*) FILTER (WHERE user_id = $1), count(*) FILTER (WHERE channel_id = $2), count(*) FILTER (WHERE guild_id = $3)
+			FROM gemini_usage
+			WHERE model = $4 AND created_at >= $5 AND (user_id = $1 OR channel_id = $2 OR guild_id = $3)
+		`, uID, cID, gID, model, today).Scan(&userUsed, &channelUsed, &guildUsed)
+		if err != nil {
+			return nil, "", err
+		}
+		switch {
+		case userQuota > 0 && userUsed+n > userQuota && userUsed < userQuota:
+			return nil, fmt.Sprintf("You only have %d of today's %d requests to `%s` left. They reset <t:%d:R>.",
+				userQuota-userUsed, userQuota, model, resets), nil
+		case userQuota > 0 && userUsed+n > userQuota:
+			return nil, fmt.Sprintf("You've used all %d of today's requests to `%s`. They reset <t:%d:R>; until then you can switch models with `/gemini settings model`.",
+				userQuota, model, resets), nil
+		case channelQuota > 0 && channelUsed+n > channelQuota:
+			return nil, fmt.Sprintf("This channel has used %d of its %d requests to `%s` today. They reset <t:%d:R>; until then you can switch models with `/gemini settings model`.",
+				channelUsed, channelQuota, model, resets), nil
+		case guildQuota > 0 && guildUsed+n > guildQuota:
+			return nil, fmt.Sprintf("This server has used %d of its %d requests to `%s` today. They reset <t:%d:R>; until then you can switch models with `/gemini settings model`.",
+				guildUsed, guildQuota, model, resets), nil
+		}
+	}
+
+	rows, err := tx.Query(ctx, `
+		INSERT INTO gemini_usage (guild_id, channel_id, user_id, model, prompt_tokens, candidates_tokens, thoughts_tokens, tool_prompt_tokens, images)
+		SELECT $1, $2, $3, $4, 0, 0, 0, 0, 0 FROM generate_series(1, $5)
+		RETURNING id
+	`, gID, cID, uID, model, n)
+	if err != nil {
+		return nil, "", err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, "", err
+	}
+	return ids, "", tx.Commit(ctx)
+}
+
+// releaseQuota gives back requests reserved by reserveQuota that weren't made.
+func releaseQuota(ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := database.Pool.Exec(context.Background(), `DELETE FROM gemini_usage WHERE id = ANY($1)`, ids); err != nil {
+		log.Println("Error releasing Gemini quota", err)
+	}
+}
+
+// reserveRequest reserves one request by m's author to model, or replies to m
+// and returns false if they have used up today's requests.
+func reserveRequest(s *discordgo.Session, m *discordgo.Message, model string) (int64, bool) {
+	ids, refusal := reserveQuota(s, m.ChannelID, m.Author.ID, model, 1)
+	if refusal != "" {
+		if _, err := s.ChannelMessageSendReply(m.ChannelID, refusal, m.Reference()); err != nil {
+			log.Println("Error sending message", err)
+		}
+		return 0, false
+	}
+	return firstReservation(ids), true
+}
+
+// firstReservation returns the one request reserved by reserveQuota, or 0 if it
+// failed open.
+func firstReservation(ids []int64) int64 {
+	if len(ids) == 0 {
+		return 0
+	}
+	return ids[0]
+}
+
+type usageRow struct {
+	model      string
+	requests   int64
+	prompt     int64
+	output     int64
+	images     int64
+	todayCount int64
+}
+
+// loadUsage sums the last usageHistoryDays of usage per model, for a user or
+// a whole server.
+func loadUsage(ctx context.Context, column string, id int64) ([]usageRow, error) {
+	now := time.Now()
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+		SELECT model,
+			count(*),
+			coalesce(sum(prompt_tokens + tool_prompt_tokens), 0),
+			coalesce(sum(candidates_tokens + thoughts_tokens), 0),
+			coalesce(sum(images), 0),
+			count(*) FILTER (WHERE created_at >= $3)
+		FROM gemini_usage
+		WHERE %s = $1 AND created_at >= $2
+		GROUP BY model
+		ORDER BY model
+	`, column), id, startOfDay(now).AddDate(0, 0, -usageHistoryDays+1), startOfDay(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var usage []usageRow
+	for rows.Next() {
+		var u usageRow
+		if err := rows.Scan(&u.model, &u.requests, &u.prompt, &u.output, &u.images, &u.todayCount); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+func formatUsage(usage []usageRow) string {
+	if len(usage) == 0 {
+		return "No requests"
+	}
+	var sb strings.Builder
+	var total float64
+	for _, u := range usage {
+		cost := estimateCost(u.model, u.prompt, u.output)
+		total += cost
+		fmt.Fprintf(&sb, "`%s`: %d requests (%d today), %d input / %d output tokens", u.model, u.requests, u.todayCount, u.prompt, u.output)
+		if u.images > 0 {
+			fmt.Fprintf(&sb, ", %d images", u.images)
+		}
+		fmt.Fprintf(&sb, ", ~$%.2f\n", cost)
+	}
+	fmt.Fprintf(&sb, "**Total: ~$%.2f**", total)
+	return sb.String()
+}
+
+func geminiUsageCommand(s *discordgo.Session, i *discordgo.InteractionCreate, userID string) {
+	ctx := context.Background()
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		log.Println("Error parsing user ID", err)
+		return
+	}
+	personal, err := loadUsage(ctx, "user_id", uID)
+	if err != nil {
+		log.Println("Error loading Gemini usage", err)
+		respondEphemeral(s, i, "Failed to load usage")
+		return
+	}
+	fields := []*discordgo.MessageEmbedField{{Name: "You", Value: getValidString(formatUsage(personal), 1024)}}
+	if i.GuildID != "" {
+		gID, err := strconv.ParseInt(i.GuildID, 10, 64)
+		if err != nil {
+			log.Println("Error parsing guild ID", err)
+			return
+		}
+		server, err := loadUsage(ctx, "guild_id", gID)
+		if err != nil {
+			log.Println("Error loading Gemini usage", err)
+			respondEphemeral(s, i, "Failed to load usage")
+			return
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "This server", Value: getValidString(formatUsage(server), 1024)})
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:  fmt.Sprintf("Gemini usage, last %d days", usageHistoryDays),
+					Color:  0xffffff,
+					Fields: fields,
+					Footer: &discordgo.MessageEmbedFooter{Text: "Costs are estimates at list prices"},
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+)
+
+const (
+	userCacheTTL      = time.Hour
+	maxCachedUsers    = 5000
+	maxUsersPerLookup = 50
+	maxEnrichedUsers  = 50
+	// Discord rate limits member lookups, so only a few run at once.
+	maxParallelUserLookups = 5
+	lookupUsersToolKey     = "lookup_users"
+)
+
+// userInfo is what the model is told about a user.
+type userInfo struct {
+	Username    string `json:"username,omitempty"`
+	GlobalName  string `json:"global_name,omitempty"`
+	Nickname    string `json:"nickname,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	JoinedAt    string `json:"joined_at,omitempty"`
+	Bot         bool   `json:"bot,omitempty"`
+	InServer    bool   `json:"in_server"`
+	Unknown     bool   `json:"unknown,omitempty"` // the user couldn't be found at all
+}
+
+type cachedUser struct {
+	info    userInfo
+	fetched time.Time
+}
+
+var (
+	userCacheMu sync.Mutex
+	userCache   = map[string]cachedUser{} // guildID + "/" + userID -> user
+
+	userMentionRegexp = regexp.MustCompile(`<@!?(\d{15,21})>`)
+
+	lookupUsersFuncDeclaration = &genai.FunctionDeclaration{
+		Name: lookupUsersToolKey,
+		Description: `Looks up Discord users by ID and returns their username, global name, server nickname, display name, when they joined the server, and whether they are still in it.
+Use this whenever you need to know who a user ID or <@user_id> mention refers to.
+Results from the other tools already include a "users" object for the IDs they contain, so only call this for IDs that aren't covered there.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"user_ids": {
+					Type:        genai.TypeArray,
+					Items:       &genai.Schema{Type: genai.TypeString},
+					Description: fmt.Sprintf("Discord user IDs or <@user_id> mentions, at most %d", maxUsersPerLookup),
+				},
+			},
+			Required: []string{"user_ids"},
+		},
+	}
+)
+
+func init() {
+	registerTool(tool{declaration: lookupUsersFuncDeclaration, handler: lookupUsersHandler})
+}
+
+// toolGuildID is the server whose members a tool's user IDs refer to: the
+// current channel's, or the archived server's outside of one.
+func toolGuildID(scope toolScope) string {
+	if ch, err := scope.s.State.Channel(scope.channelID); err == nil && ch.GuildID != "" {
+		return ch.GuildID
+	}
+	return guildID
+}
+
+// lookupUser resolves a user ID in a server, caching the result for
+// userCacheTTL. Users who left the server are looked up globally. It returns
+// false if Discord couldn't be asked, in which case nothing is cached.
+func lookupUser(ctx context.Context, s *discordgo.Session, guildID, userID string) (userInfo, bool) {
+	key := guildID + "/" + userID
+	userCacheMu.Lock()
+	cached, ok := userCache[key]
+	userCacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < userCacheTTL {
+		return cached.info, true
+	}
+
+	var info userInfo
+	member, err := s.State.Member(guildID, userID)
+	if err != nil {
+		member, err = s.GuildMember(guildID, userID, discordgo.WithContext(ctx))
+	}
+	if err == nil && member.User != nil {
+		info = userInfo{
+			Username:    member.User.Username,
+			GlobalName:  member.User.GlobalName,
+			Nickname:    member.Nick,
+			DisplayName: member.DisplayName(),
+			Bot:         member.User.Bot,
+			InServer:    true,
+		}
+		if !member.JoinedAt.IsZero() {
+			info.JoinedAt = member.JoinedAt.In(timeZone).Format(time.RFC3339)
+		}
+	} else if err != nil && !isNotFound(err) {
+		return userInfo{}, false
+	} else if user, err := s.User(userID, discordgo.WithContext(ctx)); err == nil {
+		info = userInfo{
+			Username:    user.Username,
+			GlobalName:  user.GlobalName,
+			DisplayName: user.DisplayName(),
+			Bot:         user.Bot,
+		}
+	} else if isNotFound(err) {
+		info = userInfo{Unknown: true}
+	} else {
+		return userInfo{}, false
+	}
+
+	userCacheMu.Lock()
+	if len(userCache) >= maxCachedUsers {
+		pruneUserCache()
+	}
+	userCache[key] = cachedUser{info: info, fetched: time.Now()}
+	userCacheMu.Unlock()
+	return info, true
+}
+
+// pruneUserCache drops expired users, or the oldest half of them if none have
+// expired. userCacheMu must be held.
+func pruneUserCache() {
+	maps.DeleteFunc(userCache, func(_ string, cu cachedUser) bool {
+		return time.Since(cu.fetched) >= userCacheTTL
+	})
+	if len(userCache) < maxCachedUsers {
+		return
+	}
+	fetched := make([]time.Time, 0, len(userCache))
+	for _, cu := range userCache {
+		fetched = append(fetched, cu.fetched)
+	}
+	slices.SortFunc(fetched, time.Time.Compare)
+	cutoff := fetched[len(fetched)/2]
+	maps.DeleteFunc(userCache, func(_ string, cu cachedUser) bool {
+		return !cu.fetched.After(cutoff)
+	})
+}
+
+// isNotFound reports whether a Discord request failed because what it asked
+// for doesn't exist, as opposed to a transient error.
+func isNotFound(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// lookupUsers resolves user IDs, maxParallelUserLookups at a time. Users that
+// couldn't be looked up are left out.
+func lookupUsers(ctx context.Context, s *discordgo.Session, guildID string, userIDs []string) map[string]userInfo {
+	var mu sync.Mutex
+	users := make(map[string]userInfo, len(userIDs))
+	sem := make(chan struct{}, maxParallelUserLookups)
+	var wg sync.WaitGroup
+	for _, id := range userIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			info, ok := lookupUser(ctx, s, guildID, id)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			users[id] = info
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return users
+}
+
+func lookupUsersHandler(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+	raw, _ := args["user_ids"].([]any)
+	var ids []string
+	for _, v := range raw {
+		str, _ := v.(string)
+		str = strings.TrimSpace(str)
+		if match := userMentionRegexp.FindStringSubmatch(str); match != nil {
+			str = match[1]
+		}
+		if !snowflakeRegexp.MatchString(str) {
+			return toolResult{}, fmt.Errorf("%q is not a user ID", str)
+		}
+		if !slices.Contains(ids, str) {
+			ids = append(ids, str)
+		}
+	}
+	if len(ids) == 0 {
+		return toolResult{}, errors.New("user_ids is required")
+	}
+	if len(ids) > maxUsersPerLookup {
+		return toolResult{}, fmt.Errorf("at most %d users can be looked up at once", maxUsersPerLookup)
+	}
+	users := lookupUsers(ctx, scope.s, toolGuildID(scope), ids)
+	if len(users) < len(ids) {
+		return toolResult{output: users, rows: len(users), note: "some users couldn't be looked up right now"}, nil
+	}
+	return toolResult{output: users, rows: len(users)}, nil
+}
+
+// collectUserIDs finds the user IDs in a tool's output: user_id, user_ids and
+// author_id columns, and <@user_id> mentions in any string.
+func collectUserIDs(output any) []string {
+	found := map[string]bool{}
+	add := func(id string) {
+		if snowflakeRegexp.MatchString(id) {
+			found[id] = true
+		}
+	}
+	var walk func(key string, v any)
+	walk = func(key string, v any) {
+		isUserKey := key == "user_id" || key == "user_ids" || key == "author_id"
+		switch v := v.(type) {
+		case []map[string]any:
+			for _, row := range v {
+				walk("", row)
+			}
+		case map[string]any:
+			for k, item := range v {
+				walk(k, item)
+			}
+		case []any:
+			for _, item := range v {
+				walk(key, item)
+			}
+		case []int64:
+			for _, id := range v {
+				if isUserKey {
+					add(strconv.FormatInt(id, 10))
+				}
+			}
+		case int64:
+			if isUserKey {
+				add(strconv.FormatInt(v, 10))
+			}
+		case string:
+			if isUserKey {
+				add(v)
+			}
+			for _, match := range userMentionRegexp.FindAllStringSubmatch(v, -1) {
+				add(match[1])
+			}
+		}
+	}
+	walk("", output)
+	// Maps are walked in random order, so the IDs are sorted to resolve the
+	// same ones every time.
+	ids := slices.Sorted(maps.Keys(found))
+	return ids[:min(len(ids), maxEnrichedUsers)]
+}
+
+// enrichUsers resolves the user IDs in a tool's output so the model doesn't
+// have to guess who they are.
+func enrichUsers(ctx context.Context, scope toolScope, result toolResult) map[string]userInfo {
+	ids := collectUserIDs(result.output)
+	if len(ids) == 0 {
+		return nil
+	}
+	userGuildID := result.guildID
+	if userGuildID == "" {
+		userGuildID = toolGuildID(scope)
+	}
+	return lookupUsers(ctx, scope.s, userGuildID, ids)
+}
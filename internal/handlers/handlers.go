@@ -7,9 +7,15 @@ import (
 var (
 	commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){}
 	componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){}
+	modalHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){}
+	autocompleteHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){}
 	messageCreateHandlers []func(s *discordgo.Session, m *discordgo.MessageCreate)
 	messageUpdateHandlers []func(s *discordgo.Session, m *discordgo.MessageUpdate)
 	readyHandlers []func(s *discordgo.Session, r *discordgo.Ready)
+	threadUpdateHandlers []func(s *discordgo.Session, t *discordgo.ThreadUpdate)
+	threadDeleteHandlers []func(s *discordgo.Session, t *discordgo.ThreadDelete)
+	reactionAddHandlers []func(s *discordgo.Session, r *discordgo.MessageReactionAdd)
+	tools = map[string]tool{}
 )
 
 func registerCommandHandler(name string, handler func(s *discordgo.Session, i *discordgo.InteractionCreate)) {
@@ -20,6 +26,14 @@ func registerComponentHandler(name string, handler func(s *discordgo.Session, i
 	componentHandlers[name] = handler
 }
 
+func registerModalHandler(name string, handler func(s *discordgo.Session, i *discordgo.InteractionCreate)) {
+	modalHandlers[name] = handler
+}
+
+func registerAutocompleteHandler(name string, handler func(s *discordgo.Session, i *discordgo.InteractionCreate)) {
+	autocompleteHandlers[name] = handler
+}
+
 func registerMessageCreateHandler(handler func(s *discordgo.Session, m *discordgo.MessageCreate)) {
 	messageCreateHandlers = append(messageCreateHandlers, handler)
 }
@@ -32,6 +46,22 @@ func registerReadyHandler(handler func(s *discordgo.Session, r *discordgo.Ready)
 	readyHandlers = append(readyHandlers, handler)
 }
 
+func registerThreadUpdateHandler(handler func(s *discordgo.Session, t *discordgo.ThreadUpdate)) {
+	threadUpdateHandlers = append(threadUpdateHandlers, handler)
+}
+
+func registerThreadDeleteHandler(handler func(s *discordgo.Session, t *discordgo.ThreadDelete)) {
+	threadDeleteHandlers = append(threadDeleteHandlers, handler)
+}
+
+func registerReactionAddHandler(handler func(s *discordgo.Session, r *discordgo.MessageReactionAdd)) {
+	reactionAddHandlers = append(reactionAddHandlers, handler)
+}
+
+func registerTool(t tool) {
+	tools[t.declaration.Name] = t
+}
+
 func OnInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	if i.Type == discordgo.InteractionApplicationCommand {
 		if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
@@ -41,6 +71,14 @@ func OnInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		if h, ok := componentHandlers[i.MessageComponentData().CustomID]; ok {
 			h(s, i)
 		}
+	} else if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		if h, ok := autocompleteHandlers[i.ApplicationCommandData().Name]; ok {
+			h(s, i)
+		}
+	} else if i.Type == discordgo.InteractionModalSubmit {
+		if h, ok := modalHandlers[i.ModalSubmitData().CustomID]; ok {
+			h(s, i)
+		}
 	}
 }
 
@@ -60,4 +98,22 @@ func OnReady(s *discordgo.Session, r *discordgo.Ready) {
 	for _, handler := range readyHandlers {
 		handler(s, r)
 	}
-}
\ No newline at end of file
+}
+
+func OnThreadUpdate(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	for _, handler := range threadUpdateHandlers {
+		handler(s, t)
+	}
+}
+
+func OnThreadDelete(s *discordgo.Session, t *discordgo.ThreadDelete) {
+	for _, handler := range threadDeleteHandlers {
+		handler(s, t)
+	}
+}
+
+func OnMessageReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	for _, handler := range reactionAddHandlers {
+		handler(s, r)
+	}
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	fenceRegexp          = regexp.MustCompile("^\\s*(`{3,}|~{3,})")
+	listItemRegexp       = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s`)
+	tableSeparatorRegexp = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+)
+
+type mdBlock struct {
+	lines  []string
+	fence  string // closing marker if the block is a fenced code block
+	list   bool
+	header int // number of leading lines to repeat when the block is split
+}
+
+func (b *mdBlock) String() string {
+	return strings.Join(b.lines, "\n")
+}
+
+// splitMarkdown splits text into chunks of at most limit bytes. It only breaks
+// between blocks where it can, so code fences, lists and tables stay whole
+// unless a single one is longer than limit. A fence that has to be broken is
+// closed at the end of each chunk and reopened at the start of the next, and a
+// broken table repeats its header.
+func splitMarkdown(text string, limit int) []string {
+	var chunks []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, b := range parseMarkdownBlocks(text) {
+		str := b.String()
+		if len(str) > limit {
+			flush()
+			pieces := splitMarkdownBlock(b, limit)
+			chunks = append(chunks, pieces[:len(pieces)-1]...)
+			cur.WriteString(pieces[len(pieces)-1])
+			continue
+		}
+		if cur.Len() > 0 && cur.Len()+len("\n\n")+len(str) > limit {
+			flush()
+		}
+		if cur.Len() > 0 {
+			cur.WriteString("\n\n")
+		}
+		cur.WriteString(str)
+	}
+	flush()
+	return chunks
+}
+
+// parseMarkdownBlocks splits text into blocks separated by blank lines. Fenced
+// code blocks are a single block even if they contain blank lines, and the
+// items of a loose list are kept in one block.
+func parseMarkdownBlocks(text string) []*mdBlock {
+	var blocks []*mdBlock
+	var cur *mdBlock
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		if cur != nil && cur.fence != "" {
+			cur.lines = append(cur.lines, line)
+			if strings.TrimSpace(line) != "" && strings.Trim(strings.TrimSpace(line), cur.fence[:1]) == "" && len(strings.TrimSpace(line)) >= len(cur.fence) {
+				cur = nil
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			if cur != nil {
+				blank = true
+				cur = nil
+			}
+			continue
+		}
+		if match := fenceRegexp.FindStringSubmatch(line); match != nil {
+			cur = &mdBlock{lines: []string{line}, fence: match[1]}
+			blocks = append(blocks, cur)
+			blank = false
+			continue
+		}
+		if cur == nil {
+			// A list item or indented line after a blank line continues a loose list.
+			if n := len(blocks); blank && n > 0 && blocks[n-1].list && (listItemRegexp.MatchString(line) || line[0] == ' ' || line[0] == '\t') {
+				cur = blocks[n-1]
+				cur.lines = append(cur.lines, "")
+			} else {
+				cur = &mdBlock{list: listItemRegexp.MatchString(line)}
+				blocks = append(blocks, cur)
+			}
+		}
+		cur.lines = append(cur.lines, line)
+		if len(cur.lines) == 2 && strings.HasPrefix(strings.TrimSpace(cur.lines[0]), "|") && tableSeparatorRegexp.MatchString(line) {
+			cur.header = 2
+		}
+		blank = false
+	}
+	return blocks
+}
+
+// splitMarkdownBlock splits a block that is longer than limit by lines.
+func splitMarkdownBlock(b *mdBlock, limit int) []string {
+	var prefix, suffix string
+	body := b.lines
+	if b.fence != "" {
+		prefix = b.lines[0] + "\n"
+		suffix = "\n" + b.fence
+		body = b.lines[1:]
+		if n := len(body); n > 0 && strings.TrimSpace(body[n-1]) != "" && strings.Trim(strings.TrimSpace(body[n-1]), b.fence[:1]) == "" {
+			body = body[:n-1]
+		}
+	} else if b.header > 0 {
+		prefix = strings.Join(b.lines[:b.header], "\n") + "\n"
+		body = b.lines[b.header:]
+	}
+	capacity := limit - len(prefix) - len(suffix)
+	if capacity <= 0 {
+		// The fence or table header alone doesn't fit, so give up on keeping it.
+		prefix, suffix, body, capacity = "", "", b.lines, limit
+	}
+
+	var pieces []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			pieces = append(pieces, prefix+cur.String()+suffix)
+			cur.Reset()
+		}
+	}
+	for _, line := range body {
+		for _, part := range splitLine(line, capacity) {
+			if cur.Len() > 0 && cur.Len()+len("\n")+len(part) > capacity {
+				flush()
+			}
+			if cur.Len() > 0 {
+				cur.WriteByte('\n')
+			}
+			cur.WriteString(part)
+		}
+	}
+	flush()
+	if len(pieces) == 0 {
+		pieces = append(pieces, prefix+suffix)
+	}
+	return pieces
+}
+
+// splitLine breaks a line longer than limit at spaces, or anywhere on a rune
+// boundary if there are none.
+func splitLine(line string, limit int) []string {
+	var parts []string
+	for len(line) > limit {
+		cut := strings.LastIndexByte(line[:limit], ' ')
+		if cut <= 0 {
+			cut = limit
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				_, cut = utf8.DecodeRuneInString(line)
+			}
+		}
+		parts = append(parts, line[:cut])
+		line = strings.TrimPrefix(line[cut:], " ")
+	}
+	return append(parts, line)
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/genai"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+)
+
+const (
+	scheduledMessagesSchema = `
+		CREATE TABLE IF NOT EXISTS scheduled_messages (
+			id         bigserial   PRIMARY KEY,
+			kind       text        NOT NULL,
+			channel_id bigint      NOT NULL,
+			user_id    bigint      NOT NULL,
+			send_at    timestamptz NOT NULL,
+			content    text        NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS scheduled_messages_user_id_idx ON scheduled_messages (user_id, send_at);
+	`
+
+	// Kinds of scheduled messages.
+	scheduledReminder = "reminder" // sent by the bot, mentioning the user
+	scheduledSend     = "send"     // /send, posted with both the bot and user tokens
+
+	maxReminderLength     = 1500
+	maxPendingReminders   = 25
+	maxReminderLead       = 366 * 24 * time.Hour
+	maxLateScheduledSends = time.Minute
+)
+
+type scheduledMessage struct {
+	id        int64
+	kind      string
+	channelID string
+	userID    string
+	sendAt    time.Time
+	content   string
+}
+
+var (
+	schedulerMu     sync.Mutex
+	scheduledTimers = map[int64]*time.Timer{}
+	schedulerOnce   sync.Once
+
+	scheduleMessageFuncDeclaration = &genai.FunctionDeclaration{
+		Name: "schedule_message",
+		Description: `Schedules a reminder that the bot will post in the current channel at a later time, mentioning the person who asked.
+Use this when someone asks to be reminded of something or to have a message sent later (e.g. "remind me tomorrow at 9 to call mom").
+Resolve relative times against the current time in the chat log and its timezone. Tell the user when the reminder will be sent; they can see and cancel their reminders with /remind list and /remind cancel.`,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"send_at": {
+					Type:        genai.TypeString,
+					Description: "When to send the reminder, as an RFC 3339 timestamp with a UTC offset (e.g. 2024-05-01T09:00:00-07:00)",
+				},
+				"message": {
+					Type:        genai.TypeString,
+					Description: "The reminder text, written to the person who asked",
+				},
+			},
+			Required: []string{"send_at", "message"},
+		},
+	}
+)
+
+func init() {
+	if _, err := database.Pool.Exec(context.Background(), scheduledMessagesSchema); err != nil {
+		log.Println("Error creating scheduled messages table", err)
+	}
+	registerReadyHandler(schedulerReadyHandler)
+	registerCommandHandler("remind", remindCommandHandler)
+	registerTool(tool{declaration: scheduleMessageFuncDeclaration, handler: scheduleMessageHandler})
+}
+
+// schedulerReadyHandler schedules the messages that were pending when the bot
+// last stopped.
+func schedulerReadyHandler(s *discordgo.Session, r *discordgo.Ready) {
+	schedulerOnce.Do(func() {
+		msgs, err := loadScheduledMessages(context.Background(), "", 0)
+		if err != nil {
+			log.Println("Error loading scheduled messages", err)
+			return
+		}
+		for _, sm := range msgs {
+			scheduleTimer(s, sm)
+		}
+		if len(msgs) > 0 {
+			log.Printf("Scheduled %d pending message(s)", len(msgs))
+		}
+	})
+}
+
+// scheduleMessage stores a message and sets a timer to send it, so it is sent
+// even if the bot restarts in between.
+func scheduleMessage(ctx context.Context, s *discordgo.Session, sm scheduledMessage) (int64, error) {
+	cID, err := strconv.ParseInt(sm.channelID, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	uID, err := strconv.ParseInt(sm.userID, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO scheduled_messages (kind, channel_id, user_id, send_at, content)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, sm.kind, cID, uID, sm.sendAt, sm.content).Scan(&sm.id)
+	if err != nil {
+		return 0, err
+	}
+	scheduleTimer(s, sm)
+	return sm.id, nil
+}
+
+func scheduleTimer(s *discordgo.Session, sm scheduledMessage) {
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	scheduledTimers[sm.id] = time.AfterFunc(time.Until(sm.sendAt), func() {
+		deliverScheduledMessage(s, sm)
+	})
+}
+
+func deliverScheduledMessage(s *discordgo.Session, sm scheduledMessage) {
+	schedulerMu.Lock()
+	delete(scheduledTimers, sm.id)
+	schedulerMu.Unlock()
+
+	if sm.kind == scheduledSend {
+		// /send is about the exact moment, so the row is only removed after
+		// sending. Sends can't be canceled, so nothing else removes it.
+		if late := time.Since(sm.sendAt); late > maxLateScheduledSends {
+			log.Printf("Dropping scheduled message %d, %v late", sm.id, late.Round(time.Second))
+		} else {
+			sendScheduledMessage(sm.channelID, sm.content)
+		}
+		if sm.id == 0 {
+			return // never stored
+		}
+		if _, err := database.Pool.Exec(context.Background(), `DELETE FROM scheduled_messages WHERE id = $1`, sm.id); err != nil {
+			log.Println("Error removing scheduled message", err)
+		}
+		return
+	}
+
+	// Claim a reminder first so it is never sent after being canceled.
+	tag, err := database.Pool.Exec(context.Background(), `DELETE FROM scheduled_messages WHERE id = $1`, sm.id)
+	if err != nil {
+		log.Println("Error claiming scheduled message", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		return
+	}
+	content := fmt.Sprintf("⏰ <@%s> %s", sm.userID, sm.content)
+	if time.Since(sm.sendAt) > time.Minute {
+		content += fmt.Sprintf("\n-# This reminder was due <t:%d:R>", sm.sendAt.Unix())
+	}
+	_, err = s.ChannelMessageSendComplex(sm.channelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{sm.userID}},
+	})
+	if err != nil {
+		log.Println("Error sending reminder", err)
+	}
+}
+
+// cancelScheduledMessage deletes a pending reminder owned by userID.
+func cancelScheduledMessage(ctx context.Context, id int64, userID string) (bool, error) {
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	tag, err := database.Pool.Exec(ctx, `
+		DELETE FROM scheduled_messages
+		WHERE id = $1 AND user_id = $2 AND kind = $3
+	`, id, uID, scheduledReminder)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	if timer := scheduledTimers[id]; timer != nil {
+		timer.Stop()
+		delete(scheduledTimers, id)
+	}
+	return true, nil
+}
+
+// loadScheduledMessages returns pending messages in the order they are due,
+// all of them or those of one kind for one user.
+func loadScheduledMessages(ctx context.Context, kind string, userID int64) ([]scheduledMessage, error) {
+	query := `SELECT id, kind, channel_id, user_id, send_at, content FROM scheduled_messages`
+	var args []any
+	if kind != "" {
+		query += ` WHERE kind = $1 AND user_id = $2`
+		args = append(args, kind, userID)
+	}
+	rows, err := database.Pool.Query(ctx, query+` ORDER BY send_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []scheduledMessage
+	for rows.Next() {
+		var sm scheduledMessage
+		var cID, uID int64
+		if err := rows.Scan(&sm.id, &sm.kind, &cID, &uID, &sm.sendAt, &sm.content); err != nil {
+			return nil, err
+		}
+		sm.channelID = strconv.FormatInt(cID, 10)
+		sm.userID = strconv.FormatInt(uID, 10)
+		msgs = append(msgs, sm)
+	}
+	return msgs, rows.Err()
+}
+
+func scheduleMessageHandler(ctx context.Context, scope toolScope, args map[string]any) (toolResult, error) {
+	sendAtArg, _ := args["send_at"].(string)
+	sendAt, err := time.Parse(time.RFC3339, strings.TrimSpace(sendAtArg))
+	if err != nil {
+		return toolResult{}, fmt.Errorf("send_at must be an RFC 3339 timestamp with a UTC offset: %w", err)
+	}
+	if time.Until(sendAt) <= 0 {
+		return toolResult{}, errors.New("send_at is in the past")
+	}
+	if time.Until(sendAt) > maxReminderLead {
+		return toolResult{}, errors.New("reminders can be at most a year ahead")
+	}
+	message, _ := args["message"].(string)
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return toolResult{}, errors.New("message is required")
+	}
+	if len(message) > maxReminderLength {
+		return toolResult{}, fmt.Errorf("message must be at most %d characters", maxReminderLength)
+	}
+
+	uID, err := strconv.ParseInt(scope.requesterID, 10, 64)
+	if err != nil {
+		return toolResult{}, err
+	}
+	pending, err := loadScheduledMessages(ctx, scheduledReminder, uID)
+	if err != nil {
+		return toolResult{}, err
+	}
+	if len(pending) >= maxPendingReminders {
+		return toolResult{}, fmt.Errorf("the user already has %d pending reminders; they need to cancel some with /remind cancel first", len(pending))
+	}
+
+	id, err := scheduleMessage(ctx, scope.s, scheduledMessage{
+		kind:      scheduledReminder,
+		channelID: scope.channelID,
+		userID:    scope.requesterID,
+		sendAt:    sendAt,
+		content:   message,
+	})
+	if err != nil {
+		return toolResult{}, err
+	}
+	return toolResult{
+		output: map[string]any{"id": id, "send_at": sendAt.In(timeZone).Format(time.RFC3339)},
+		rows:   1,
+	}, nil
+}
+
+func remindCommandHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	var userID string
+	if i.Member != nil {
+		userID = i.Member.User.ID
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+	uID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		log.Println("Error parsing user ID", err)
+		return
+	}
+
+	var content string
+	option := i.ApplicationCommandData().Options[0]
+	switch option.Name {
+	case "list":
+		msgs, err := loadScheduledMessages(context.Background(), scheduledReminder, uID)
+		if err != nil {
+			log.Println("Error loading reminders", err)
+			content = "Failed to load your reminders"
+			break
+		}
+		if len(msgs) == 0 {
+			content = "You have no pending reminders"
+			break
+		}
+		var sb strings.Builder
+		for _, sm := range msgs {
+			text := strings.Join(strings.Fields(sm.content), " ")
+			if len(text) > 100 {
+				text = strings.ToValidUTF8(text[:100], "") + "…"
+			}
+			fmt.Fprintf(&sb, "`%d` <t:%d:f> in <#%s>: %s\n", sm.id, sm.sendAt.Unix(), sm.channelID, text)
+		}
+		content = getValidString(sb.String(), maxMsgLength)
+	case "cancel":
+		id := option.Options[0].IntValue()
+		ok, err := cancelScheduledMessage(context.Background(), id, userID)
+		if err != nil {
+			log.Println("Error canceling reminder", err)
+			content = "Failed to cancel the reminder"
+		} else if !ok {
+			content = fmt.Sprintf("You have no pending reminder with ID `%d`", id)
+		} else {
+			content = fmt.Sprintf("Canceled reminder `%d`", id)
+		}
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
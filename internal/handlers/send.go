@@ -1,7 +1,9 @@
 package handlers
 
 import (
-	"strings"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,14 +14,18 @@ import (
 
 var (
 	msgNum = 0
-	requestBody = `{"content": "Scheduled message %d sent."}`
 	authorizationHeader = fmt.Sprintf("Bot %s", os.Getenv("BOT_TOKEN"))
 	userAuthorizationHeader = os.Getenv("USER_TOKEN")
 )
 
-func sendScheduledMessage(channelID string, num int) {
+func sendScheduledMessage(channelID string, content string) {
+	body, err := json.Marshal(map[string]string{"content": content})
+	if err != nil {
+		log.Println("Could not encode scheduled message", err)
+		return
+	}
 	send := func(auth string) {
-		if req, err := http.NewRequest("POST", fmt.Sprintf("https://discord.com/api/channels/%s/messages", channelID), strings.NewReader(fmt.Sprintf(requestBody, num))); err != nil {
+		if req, err := http.NewRequest("POST", fmt.Sprintf("https://discord.com/api/channels/%s/messages", channelID), bytes.NewReader(body)); err != nil {
 			log.Println("Could not create new HTTP request", err)
 		} else {
 			req.Header.Add("Authorization", auth)
@@ -39,6 +45,19 @@ func sendCommandHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	sendTime := i.ApplicationCommandData().Options[0].IntValue()
 	msgNum++
 	num := msgNum
+	var userID string
+	if i.Member != nil {
+		userID = i.Member.User.ID
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+	sm := scheduledMessage{
+		kind: scheduledSend,
+		channelID: i.ChannelID,
+		userID: userID,
+		sendAt: time.UnixMilli(sendTime),
+		content: fmt.Sprintf("Scheduled message %d sent.", num),
+	}
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
@@ -46,6 +65,11 @@ func sendCommandHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
 			Flags: discordgo.MessageFlagsEphemeral,
 		},
 	})
-	time.Sleep(time.Duration(sendTime * 1000000 - time.Now().UnixNano()))
-	sendScheduledMessage(i.ChannelID, num)
+	if _, err := scheduleMessage(context.Background(), s, sm); err != nil {
+		// Still send it, it just won't survive a restart.
+		log.Println("Could not store scheduled message", err)
+		time.AfterFunc(time.Until(sm.sendAt), func() {
+			deliverScheduledMessage(s, sm)
+		})
+	}
 }
\ No newline at end of file
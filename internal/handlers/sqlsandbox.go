@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/anishmit/discordgo-bot/internal/database"
+	"github.com/anishmit/discordgo-bot/internal/sqlsandbox"
+)
+
+const (
+	sandboxStatementTimeout = 10 * time.Second
+	sandboxMaxRows          = 200
+	sandboxMaxValueChars    = 1000
+	sandboxMaxResultBytes   = 32000
+)
+
+// checkSandboxRole checks that queries written by the model run as their own
+// role, which can't be the main pool's role or a superuser.
+func checkSandboxRole(ctx context.Context) error {
+	if database.ReadOnlyPool == nil {
+		return errors.New("DATABASE_READONLY_URL is not set")
+	}
+	var mainRole, role string
+	var superuser bool
+	if err := database.Pool.QueryRow(ctx, `SELECT current_user::text`).Scan(&mainRole); err != nil {
+		return err
+	}
+	err := database.ReadOnlyPool.QueryRow(ctx, `
+		SELECT current_user::text, rolsuper
+		FROM pg_roles
+		WHERE rolname = current_user
+	`).Scan(&role, &superuser)
+	if err != nil {
+		return err
+	}
+	if role == mainRole || superuser {
+		return fmt.Errorf("DATABASE_READONLY_URL must use a restricted role, not %s", role)
+	}
+	return nil
+}
+
+// sandboxedQuery validates a query written by the model and runs it in a
+// read-only transaction with a statement timeout. At most sandboxMaxRows rows
+// are returned, and the note explains anything that was cut from the result.
+func sandboxedQuery(ctx context.Context, query string, tables []string) ([]map[string]any, string, error) {
+	query, err := sqlsandbox.ValidateSelect(query, tables)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tx, err := database.ReadOnlyPool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", sandboxStatementTimeout.Milliseconds())); err != nil {
+		return nil, "", err
+	}
+
+	// The newlines keep a trailing line comment from swallowing the parenthesis.
+	rows, err := tx.Query(ctx, fmt.Sprintf("SELECT * FROM (\n%s\n) AS sandboxed LIMIT %d", query, sandboxMaxRows+1))
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var results []map[string]any
+	fields := rows.FieldDescriptions()
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, "", err
+		}
+		row := make(map[string]any, len(fields))
+		for i, fd := range fields {
+			row[string(fd.Name)] = truncateValue(values[i])
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var notes []string
+	if len(results) > sandboxMaxRows {
+		results = results[:sandboxMaxRows]
+		notes = append(notes, fmt.Sprintf("only the first %d rows were returned", sandboxMaxRows))
+	}
+	if n := fitResult(results); n < len(results) {
+		results = results[:n]
+		notes = append(notes, fmt.Sprintf("the result was too large, so only the first %d rows were returned", n))
+	}
+	if len(notes) > 0 {
+		return results, strings.Join(notes, "; ") + "; narrow the query or aggregate to see the rest", nil
+	}
+	return results, "", nil
+}
+
+func truncateValue(v any) any {
+	s, ok := v.(string)
+	if !ok || len(s) <= sandboxMaxValueChars {
+		return v
+	}
+	return strings.ToValidUTF8(s[:sandboxMaxValueChars], "") + "…"
+}
+
+// fitResult returns how many leading rows fit in sandboxMaxResultBytes of JSON.
+func fitResult(results []map[string]any) int {
+	size := 0
+	for i, row := range results {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return i
+		}
+		size += len(data) + 1
+		if size > sandboxMaxResultBytes {
+			return i
+		}
+	}
+	return len(results)
+}
@@ -0,0 +1,404 @@
+// Package sqlsandbox checks that SQL written by a model only reads from the
+// tables it is allowed to see.
+package sqlsandbox
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var (
+	// Statements and clauses that can change data or the session. The
+	// read-only transaction rejects most of them anyway.
+	sandboxForbiddenKeywords = map[string]bool{
+		"insert": true, "update": true, "delete": true, "merge": true, "upsert": true,
+		"create": true, "alter": true, "drop": true, "truncate": true, "rename": true,
+		"grant": true, "revoke": true, "copy": true, "call": true, "do": true,
+		"execute": true, "prepare": true, "deallocate": true, "lock": true, "set": true,
+		"reset": true, "vacuum": true, "analyze": true, "reindex": true, "cluster": true,
+		"comment": true, "listen": true, "notify": true, "unlisten": true, "into": true,
+		"table": true, "begin": true, "commit": true, "rollback": true, "savepoint": true,
+		"discard": true, "refresh": true, "security": true, "import": true, "load": true,
+	}
+
+	// The functions a query may call. Any other call is rejected, since many
+	// built-in functions run queries given as text (ts_stat, query_to_xml),
+	// dump whole schemas or read files and the server's state.
+	sandboxAllowedFunctions = map[string]bool{
+		// Aggregate and window functions
+		"count": true, "sum": true, "avg": true, "min": true, "max": true, "array_agg": true,
+		"string_agg": true, "json_agg": true, "jsonb_agg": true, "json_object_agg": true,
+		"jsonb_object_agg": true, "bool_and": true, "bool_or": true, "every": true,
+		"stddev": true, "stddev_pop": true, "stddev_samp": true, "variance": true,
+		"var_pop": true, "var_samp": true, "corr": true, "percentile_cont": true,
+		"percentile_disc": true, "mode": true, "row_number": true, "rank": true,
+		"dense_rank": true, "percent_rank": true, "cume_dist": true, "ntile": true, "lag": true,
+		"lead": true, "first_value": true, "last_value": true, "nth_value": true,
+		"grouping": true, "rollup": true, "cube": true,
+		// Conditional expressions
+		"coalesce": true, "nullif": true, "greatest": true, "least": true, "cast": true, "row": true,
+		// Math
+		"abs": true, "ceil": true, "ceiling": true, "floor": true, "round": true, "trunc": true,
+		"mod": true, "power": true, "sqrt": true, "exp": true, "ln": true, "log": true,
+		"log10": true, "sign": true, "div": true, "width_bucket": true,
+		// Strings
+		"length": true, "char_length": true, "character_length": true, "octet_length": true,
+		"lower": true, "upper": true, "initcap": true, "trim": true, "btrim": true, "ltrim": true,
+		"rtrim": true, "substring": true, "substr": true, "position": true, "strpos": true,
+		"replace": true, "translate": true, "left": true, "right": true, "lpad": true,
+		"rpad": true, "repeat": true, "reverse": true, "split_part": true, "concat": true,
+		"concat_ws": true, "format": true, "md5": true, "starts_with": true,
+		"regexp_replace": true, "regexp_match": true, "regexp_matches": true,
+		"regexp_count": true, "regexp_like": true, "regexp_split_to_array": true,
+		"regexp_split_to_table": true, "string_to_array": true, "array_to_string": true,
+		"to_char": true, "to_number": true, "to_hex": true, "ascii": true, "chr": true,
+		// Dates and times
+		"now": true, "date_trunc": true, "date_part": true, "extract": true, "age": true,
+		"to_timestamp": true, "to_date": true, "make_date": true, "make_interval": true,
+		"make_timestamp": true, "make_timestamptz": true, "date_bin": true, "timezone": true,
+		"justify_days": true, "justify_hours": true, "justify_interval": true, "isfinite": true,
+		// Arrays and JSON
+		"array_length": true, "cardinality": true, "array_position": true,
+		"array_positions": true, "array_append": true, "array_prepend": true, "array_cat": true,
+		"array_remove": true, "array_upper": true, "array_lower": true, "unnest": true,
+		"generate_series": true, "to_json": true, "to_jsonb": true, "json_build_object": true,
+		"jsonb_build_object": true, "json_build_array": true, "jsonb_build_array": true,
+		"json_array_length": true, "jsonb_array_length": true, "json_array_elements": true,
+		"jsonb_array_elements": true, "json_array_elements_text": true,
+		"jsonb_array_elements_text": true, "json_object_keys": true, "jsonb_object_keys": true,
+		"json_each": true, "jsonb_each": true, "json_each_text": true, "jsonb_each_text": true,
+		"json_extract_path": true, "jsonb_extract_path": true, "json_extract_path_text": true,
+		"jsonb_extract_path_text": true, "json_typeof": true, "jsonb_typeof": true,
+		"jsonb_path_query": true, "jsonb_path_query_array": true, "jsonb_path_query_first": true,
+		"jsonb_path_exists": true, "jsonb_strip_nulls": true,
+		// Types that take a modifier, as in CAST(x AS numeric(10, 2)) or x::varchar(20)
+		"numeric": true, "decimal": true, "varchar": true, "char": true, "character": true,
+		"varying": true, "bit": true, "timestamp": true, "timestamptz": true, "time": true,
+		"timetz": true, "interval": true, "float": true,
+	}
+
+	// Keywords that may be directly followed by a parenthesized expression or
+	// subquery, so a parenthesis after them doesn't start a function call.
+	sandboxKeywords = map[string]bool{
+		"select": true, "with": true, "recursive": true, "from": true, "join": true,
+		"where": true, "and": true, "or": true, "not": true, "in": true, "exists": true,
+		"any": true, "all": true, "some": true, "as": true, "on": true, "using": true,
+		"values": true, "lateral": true, "over": true, "filter": true, "within": true,
+		"union": true, "intersect": true, "except": true, "case": true, "when": true,
+		"then": true, "else": true, "array": true, "materialized": true, "having": true,
+		"by": true, "limit": true, "offset": true, "is": true, "like": true, "ilike": true,
+		"between": true, "distinct": true, "zone": true,
+	}
+
+	// Keywords that end a FROM list at the same nesting level.
+	sandboxFromEnd = map[string]bool{
+		"where": true, "group": true, "having": true, "window": true, "order": true,
+		"limit": true, "offset": true, "fetch": true, "for": true, "union": true,
+		"intersect": true, "except": true, "select": true,
+	}
+)
+
+type sqlTokenKind int
+
+const (
+	sqlIdent sqlTokenKind = iota
+	sqlQuotedIdent
+	sqlString
+	sqlNumber
+	sqlPunct
+)
+
+type sqlToken struct {
+	kind  sqlTokenKind
+	value string // lowercased for unquoted identifiers
+}
+
+func (t sqlToken) is(kind sqlTokenKind, value string) bool {
+	return t.kind == kind && t.value == value
+}
+
+func (t sqlToken) isIdent() bool {
+	return t.kind == sqlIdent || t.kind == sqlQuotedIdent
+}
+
+// tokenizeSQL splits a query into tokens, dropping whitespace and comments. It
+// rejects dollar signs outside of identifiers, which rules out both dollar
+// quoting and bind parameters.
+func tokenizeSQL(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	r := []rune(query)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			depth := 0
+			for ; i < len(r); i++ {
+				if r[i] == '/' && i+1 < len(r) && r[i+1] == '*' {
+					depth++
+					i++
+				} else if r[i] == '*' && i+1 < len(r) && r[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						i++
+						break
+					}
+				}
+			}
+			if depth != 0 {
+				return nil, errors.New("unterminated comment")
+			}
+		case c == '\'':
+			end, err := scanQuoted(r, i, '\'', false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: sqlString, value: string(r[i:end])})
+			i = end
+		case c == '"':
+			end, err := scanQuoted(r, i, '"', false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: sqlQuotedIdent, value: strings.ReplaceAll(string(r[i+1:end-1]), `""`, `"`)})
+			i = end
+		case c == '$':
+			return nil, errors.New("dollar-quoted strings and parameters are not allowed")
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(r) && (unicode.IsLetter(r[i]) || unicode.IsDigit(r[i]) || r[i] == '_' || r[i] == '$') {
+				i++
+			}
+			word := strings.ToLower(string(r[start:i]))
+			if word == "e" && i < len(r) && r[i] == '\'' {
+				end, err := scanQuoted(r, i, '\'', true)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, sqlToken{kind: sqlString, value: string(r[start:end])})
+				i = end
+				continue
+			}
+			tokens = append(tokens, sqlToken{kind: sqlIdent, value: word})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(r) && (unicode.IsDigit(r[i]) || unicode.IsLetter(r[i]) || r[i] == '.' || r[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlNumber, value: string(r[start:i])})
+		default:
+			tokens = append(tokens, sqlToken{kind: sqlPunct, value: string(c)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// scanQuoted returns the index just past the quoted string or identifier that
+// starts at r[start]. A doubled quote is an escaped quote, and so is a
+// backslash-escaped one if backslashEscapes is set.
+func scanQuoted(r []rune, start int, quote rune, backslashEscapes bool) (int, error) {
+	for i := start + 1; i < len(r); i++ {
+		switch {
+		case backslashEscapes && r[i] == '\\':
+			i++
+		case r[i] == quote && i+1 < len(r) && r[i+1] == quote:
+			i++
+		case r[i] == quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated %c", quote)
+}
+
+// ValidateSelect checks that query is a single SELECT (optionally with CTEs)
+// that only reads from tables, and returns it without a trailing semicolon.
+func ValidateSelect(query string, tables []string) (string, error) {
+	tokens, err := tokenizeSQL(query)
+	if err != nil {
+		return "", err
+	}
+	query = strings.TrimSpace(query)
+	for len(tokens) > 0 && tokens[len(tokens)-1].is(sqlPunct, ";") {
+		tokens = tokens[:len(tokens)-1]
+		query = strings.TrimSpace(strings.TrimSuffix(query, ";"))
+	}
+	if len(tokens) == 0 {
+		return "", errors.New("query is empty")
+	}
+	if !tokens[0].is(sqlIdent, "select") && !tokens[0].is(sqlIdent, "with") {
+		return "", errors.New("only SELECT queries are allowed")
+	}
+
+	for i, t := range tokens {
+		if t.is(sqlPunct, ";") {
+			return "", errors.New("only a single statement is allowed")
+		}
+		if !t.isIdent() {
+			continue
+		}
+		name := strings.ToLower(t.value)
+		if t.kind == sqlIdent && sandboxForbiddenKeywords[name] {
+			return "", fmt.Errorf("%s is not allowed", strings.ToUpper(name))
+		}
+		if strings.HasPrefix(name, "pg_") || strings.HasPrefix(name, "lo_") || name == "information_schema" {
+			return "", fmt.Errorf("%s is not allowed", t.value)
+		}
+		if i+1 < len(tokens) && tokens[i+1].is(sqlPunct, "(") && !isAllowedCall(tokens, i) {
+			return "", fmt.Errorf("function %s is not allowed; use common functions only, and name a CTE's columns inside its query", t.value)
+		}
+	}
+
+	allowed := append(slices.Clone(tables), cteNames(tokens)...)
+	if err := checkTableReferences(tokens, allowed, tables); err != nil {
+		return "", err
+	}
+	return query, nil
+}
+
+// isAllowedCall reports whether the identifier at tokens[i], which is followed
+// by a parenthesis, is a keyword, an allowed function, or an alias with a
+// column list as in "AS t(a, b)". The column list form of a CTE isn't
+// accepted, since a name in that position can't be told from a call.
+func isAllowedCall(tokens []sqlToken, i int) bool {
+	t := tokens[i]
+	// Schema-qualified names are never allowed functions, since a schema can
+	// define its own function named like an allowed one.
+	if i > 0 && tokens[i-1].is(sqlPunct, ".") {
+		return false
+	}
+	if t.kind == sqlIdent && (sandboxKeywords[t.value] || sandboxAllowedFunctions[t.value]) {
+		return true
+	}
+	return i > 0 && tokens[i-1].is(sqlIdent, "as")
+}
+
+// cteNames returns the names defined by "name AS (" and "name (columns) AS (".
+func cteNames(tokens []sqlToken) []string {
+	var names []string
+	for i := 1; i+1 < len(tokens); i++ {
+		if !tokens[i].is(sqlIdent, "as") {
+			continue
+		}
+		next := i + 1
+		if tokens[next].is(sqlIdent, "not") {
+			next++
+		}
+		if next < len(tokens) && tokens[next].is(sqlIdent, "materialized") {
+			next++
+		}
+		if next >= len(tokens) || !tokens[next].is(sqlPunct, "(") {
+			continue
+		}
+		j := i - 1
+		if tokens[j].is(sqlPunct, ")") {
+			depth := 0
+			for ; j >= 0; j-- {
+				if tokens[j].is(sqlPunct, ")") {
+					depth++
+				} else if tokens[j].is(sqlPunct, "(") {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			j--
+		}
+		if j >= 0 && tokens[j].isIdent() {
+			names = append(names, tokens[j].value)
+		}
+	}
+	return names
+}
+
+// checkTableReferences checks every relation named in a FROM list or JOIN,
+// including those inside a parenthesized join such as (a JOIN b ON true).
+// FROM inside a function call's parentheses, as in EXTRACT(YEAR FROM x), is
+// not a FROM clause and is skipped.
+func checkTableReferences(tokens []sqlToken, allowed, tables []string) error {
+	type frame struct {
+		call     bool
+		fromList bool
+	}
+	stack := []*frame{{}}
+	expectTable := false
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		top := stack[len(stack)-1]
+
+		if expectTable {
+			switch {
+			case t.is(sqlIdent, "lateral") || t.is(sqlIdent, "only"):
+				continue
+			case t.is(sqlPunct, "(") && !startsQuery(tokens, i+1):
+				// A parenthesized join, whose first relation is still
+				// expected.
+				stack = append(stack, &frame{fromList: true})
+				continue
+			case t.isIdent():
+				expectTable = false
+				name := t.value
+				if i+2 < len(tokens) && tokens[i+1].is(sqlPunct, ".") && tokens[i+2].isIdent() {
+					if strings.ToLower(name) != "public" {
+						return fmt.Errorf("schema %s is not available", name)
+					}
+					i += 2
+					name = tokens[i].value
+				}
+				if i+1 < len(tokens) && tokens[i+1].is(sqlPunct, "(") {
+					// A set-returning function such as generate_series.
+					continue
+				}
+				if !slices.Contains(allowed, name) {
+					return fmt.Errorf("table %s is not available; this tool can only query %s", name, strings.Join(tables, ", "))
+				}
+				continue
+			default:
+				expectTable = false
+			}
+		}
+
+		switch {
+		case t.is(sqlPunct, "("):
+			call := i > 0 && tokens[i-1].kind == sqlIdent && !sandboxKeywords[tokens[i-1].value]
+			if startsQuery(tokens, i+1) {
+				call = false
+			}
+			stack = append(stack, &frame{call: call})
+		case t.is(sqlPunct, ")"):
+			if len(stack) == 1 {
+				return errors.New("unbalanced parentheses")
+			}
+			stack = stack[:len(stack)-1]
+		case top.call:
+		case t.is(sqlIdent, "from"):
+			top.fromList = true
+			expectTable = true
+		case t.is(sqlIdent, "join"):
+			expectTable = true
+		case t.is(sqlPunct, ",") && top.fromList:
+			expectTable = true
+		case t.kind == sqlIdent && sandboxFromEnd[t.value]:
+			top.fromList = false
+		}
+	}
+	if len(stack) != 1 {
+		return errors.New("unbalanced parentheses")
+	}
+	return nil
+}
+
+// startsQuery reports whether tokens[i] starts a subquery.
+func startsQuery(tokens []sqlToken, i int) bool {
+	return i < len(tokens) && (tokens[i].is(sqlIdent, "select") || tokens[i].is(sqlIdent, "with") || tokens[i].is(sqlIdent, "values"))
+}
@@ -0,0 +1,57 @@
+package sqlsandbox
+
+import "testing"
+
+func TestValidateSelect(t *testing.T) {
+	tables := []string{"messages", "first_messages"}
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"simple", "SELECT * FROM messages", true},
+		{"trailing semicolon", "SELECT count(*) FROM messages;", true},
+		{"join", "SELECT m.content FROM messages m JOIN first_messages f ON f.user_id = m.user_id", true},
+		{"from list", "SELECT * FROM messages, first_messages", true},
+		{"cte", "WITH recent AS (SELECT * FROM messages) SELECT * FROM recent", true},
+		{"subquery", "SELECT * FROM (SELECT * FROM messages) AS m", true},
+		{"parenthesized join", "SELECT * FROM (messages m JOIN first_messages f ON true)", true},
+		{"subquery in parenthesized join", "SELECT * FROM ((SELECT * FROM messages) m JOIN first_messages f ON true)", true},
+		{"function", "SELECT date_trunc('day', created_at), count(*) FROM messages GROUP BY 1", true},
+		{"extract", "SELECT EXTRACT(YEAR FROM created_at) FROM messages", true},
+		{"set-returning function", "SELECT * FROM generate_series(1, 3)", true},
+		{"public schema", "SELECT * FROM public.messages", true},
+
+		{"empty", "  ;", false},
+		{"not a select", "DELETE FROM messages", false},
+		{"two statements", "SELECT 1; SELECT 2", false},
+		{"other table", "SELECT * FROM secrets", false},
+		{"other table in join", "SELECT * FROM messages JOIN secrets ON true", false},
+		{"other table in from list", "SELECT * FROM messages, secrets", false},
+		{"other table in subquery", "SELECT (SELECT count(*) FROM secrets) FROM messages", false},
+		{"other schema", "SELECT * FROM private.messages", false},
+		{"catalog", "SELECT * FROM pg_authid", false},
+		{"information schema", "SELECT * FROM information_schema.tables", false},
+		{"parenthesized cross join", "SELECT * FROM (secrets CROSS JOIN messages)", false},
+		{"parenthesized join with alias", "SELECT * FROM (gemini_user_settings s JOIN messages m ON true)", false},
+		{"parenthesized natural join in from list", "SELECT * FROM messages, (gemini_history NATURAL JOIN first_messages)", false},
+		{"nested parentheses", "SELECT * FROM ((secrets) JOIN messages ON true)", false},
+		{"parenthesized join after join", "SELECT * FROM messages JOIN (secrets CROSS JOIN first_messages) ON true", false},
+		{"disallowed function", "SELECT query_to_xml('SELECT * FROM secrets', true, true, '')", false},
+		{"schema-qualified function", "SELECT public.lower(content) FROM messages", false},
+		{"dollar quoting", "SELECT $$x$$", false},
+		{"into", "SELECT * INTO copy FROM messages", false},
+		{"unbalanced parentheses", "SELECT (1 FROM messages", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateSelect(tt.query, tables)
+			if tt.ok && err != nil {
+				t.Errorf("ValidateSelect(%q) = %v, want no error", tt.query, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("ValidateSelect(%q) succeeded, want an error", tt.query)
+			}
+		})
+	}
+}
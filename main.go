@@ -25,6 +25,9 @@ func main() {
 	s.AddHandler(handlers.OnMessageCreate)
 	s.AddHandler(handlers.OnMessageUpdate)
 	s.AddHandler(handlers.OnReady)
+	s.AddHandler(handlers.OnThreadUpdate)
+	s.AddHandler(handlers.OnThreadDelete)
+	s.AddHandler(handlers.OnMessageReactionAdd)
 
 	err := s.Open()
 	if err != nil {